@@ -0,0 +1,536 @@
+package memcache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/ybc/bindings/go/ybc"
+)
+
+// Binary protocol magic bytes. See
+// https://github.com/memcached/memcached/wiki/BinaryProtocolRevamped
+const (
+	binaryMagicRequest  = 0x80
+	binaryMagicResponse = 0x81
+)
+
+// Binary protocol opcodes.
+const (
+	opGet        = 0x00
+	opSet        = 0x01
+	opAdd        = 0x02
+	opReplace    = 0x03
+	opDelete     = 0x04
+	opIncrement  = 0x05
+	opDecrement  = 0x06
+	opQuit       = 0x07
+	opFlush      = 0x08
+	opGetQ       = 0x09
+	opNoop       = 0x0A
+	opVersion    = 0x0B
+	opGetK       = 0x0C
+	opGetKQ      = 0x0D
+	opAppend     = 0x0E
+	opPrepend    = 0x0F
+	opStat       = 0x10
+	opSetQ       = 0x11
+	opAddQ       = 0x12
+	opReplaceQ   = 0x13
+	opDeleteQ    = 0x14
+	opIncrementQ = 0x15
+	opDecrementQ = 0x16
+	opQuitQ      = 0x17
+	opFlushQ     = 0x18
+	opAppendQ    = 0x19
+	opPrependQ   = 0x1A
+)
+
+// Binary protocol status codes.
+const (
+	statusNoError            = 0x0000
+	statusKeyNotFound        = 0x0001
+	statusKeyExists          = 0x0002
+	statusValueTooLarge      = 0x0003
+	statusInvalidArguments   = 0x0004
+	statusItemNotStored      = 0x0005
+	statusNonNumericValue    = 0x0006
+	statusUnknownCommand     = 0x0081
+	statusOutOfMemory        = 0x0082
+	binaryHeaderSize         = 24
+	binaryFlagsExtrasSize    = 8
+	binaryIncrDecrExtrasSize = 20
+)
+
+type binaryHeader struct {
+	opcode    byte
+	keyLen    uint16
+	extrasLen byte
+	status    uint16
+	bodyLen   uint32
+	opaque    uint32
+	cas       uint64
+}
+
+func readBinaryHeader(r *bufio.Reader) (binaryHeader, bool) {
+	buf := make([]byte, binaryHeaderSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err != io.EOF {
+			log.Printf("Error when reading binary protocol header: [%s]", err)
+		}
+		return binaryHeader{}, false
+	}
+	if buf[0] != binaryMagicRequest {
+		log.Printf("Unexpected magic byte=[%x] in binary protocol header", buf[0])
+		return binaryHeader{}, false
+	}
+	h := binaryHeader{
+		opcode:    buf[1],
+		keyLen:    binary.BigEndian.Uint16(buf[2:4]),
+		extrasLen: buf[4],
+		bodyLen:   binary.BigEndian.Uint32(buf[8:12]),
+		opaque:    binary.BigEndian.Uint32(buf[12:16]),
+		cas:       binary.BigEndian.Uint64(buf[16:24]),
+	}
+	return h, true
+}
+
+// writeBinaryHeader writes a 24-byte response header followed by
+// extras and key, but not the value - callers stream the value
+// themselves (directly from a ybc.Item, in the Get case) to avoid
+// buffering it.
+func writeBinaryHeader(w *bufio.Writer, opcode byte, status uint16, opaque uint32, cas uint64, extras, key []byte, valueLen int) bool {
+	buf := make([]byte, binaryHeaderSize)
+	buf[0] = binaryMagicResponse
+	buf[1] = opcode
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(key)))
+	buf[4] = byte(len(extras))
+	binary.BigEndian.PutUint16(buf[6:8], status)
+	binary.BigEndian.PutUint32(buf[8:12], uint32(len(extras)+len(key)+valueLen))
+	binary.BigEndian.PutUint32(buf[12:16], opaque)
+	binary.BigEndian.PutUint64(buf[16:24], cas)
+	if _, err := w.Write(buf); err != nil {
+		log.Printf("Error when writing binary protocol response header: [%s]", err)
+		return false
+	}
+	if len(extras) > 0 {
+		if _, err := w.Write(extras); err != nil {
+			log.Printf("Error when writing binary protocol response extras: [%s]", err)
+			return false
+		}
+	}
+	if len(key) > 0 {
+		if _, err := w.Write(key); err != nil {
+			log.Printf("Error when writing binary protocol response key: [%s]", err)
+			return false
+		}
+	}
+	return true
+}
+
+func writeBinaryResponse(w *bufio.Writer, opcode byte, status uint16, opaque uint32, cas uint64, extras, key, value []byte) bool {
+	if !writeBinaryHeader(w, opcode, status, opaque, cas, extras, key, len(value)) {
+		return false
+	}
+	if len(value) == 0 {
+		return true
+	}
+	if _, err := w.Write(value); err != nil {
+		log.Printf("Error when writing binary protocol response value: [%s]", err)
+		return false
+	}
+	return true
+}
+
+func writeBinaryError(w *bufio.Writer, opcode byte, status uint16, opaque uint32, msg string) bool {
+	return writeBinaryResponse(w, opcode, status, opaque, 0, nil, nil, []byte(msg))
+}
+
+// casTable tracks a synthetic CAS counter per key, since ybc items
+// don't carry CAS metadata of their own. It is striped the same way
+// the RESP frontend stripes its key locks, to keep the common case
+// (distinct keys) lock-free across each other.
+const casTableStripeCount = 256
+
+type casTable struct {
+	mu      [casTableStripeCount]sync.Mutex
+	stripes [casTableStripeCount]map[string]uint64
+}
+
+func newCasTable() *casTable {
+	t := &casTable{}
+	for i := range t.stripes {
+		t.stripes[i] = make(map[string]uint64)
+	}
+	return t
+}
+
+func (t *casTable) stripe(key []byte) int {
+	h := uint32(2166136261)
+	for _, b := range key {
+		h ^= uint32(b)
+		h *= 16777619
+	}
+	return int(h % casTableStripeCount)
+}
+
+// bump increments and returns the CAS value stored for key.
+func (t *casTable) bump(key []byte) uint64 {
+	i := t.stripe(key)
+	t.mu[i].Lock()
+	defer t.mu[i].Unlock()
+	t.stripes[i][string(key)]++
+	return t.stripes[i][string(key)]
+}
+
+func (t *casTable) get(key []byte) uint64 {
+	i := t.stripe(key)
+	t.mu[i].Lock()
+	defer t.mu[i].Unlock()
+	return t.stripes[i][string(key)]
+}
+
+func (t *casTable) del(key []byte) {
+	i := t.stripe(key)
+	t.mu[i].Lock()
+	defer t.mu[i].Unlock()
+	delete(t.stripes[i], string(key))
+}
+
+func readBinaryBody(r *bufio.Reader, h binaryHeader) (extras, key []byte, valueLen int, ok bool) {
+	extras = make([]byte, h.extrasLen)
+	if len(extras) > 0 {
+		if _, err := io.ReadFull(r, extras); err != nil {
+			log.Printf("Error when reading binary protocol extras: [%s]", err)
+			return nil, nil, 0, false
+		}
+	}
+	key = make([]byte, h.keyLen)
+	if len(key) > 0 {
+		if _, err := io.ReadFull(r, key); err != nil {
+			log.Printf("Error when reading binary protocol key: [%s]", err)
+			return nil, nil, 0, false
+		}
+	}
+	valueLen = int(h.bodyLen) - int(h.extrasLen) - int(h.keyLen)
+	if valueLen < 0 {
+		return nil, nil, 0, false
+	}
+	return extras, key, valueLen, true
+}
+
+// isQuiet reports whether opcode is a "quiet" variant that only
+// responds on error, per the binary protocol spec.
+func isQuiet(opcode byte) bool {
+	switch opcode {
+	case opGetQ, opGetKQ, opSetQ, opAddQ, opReplaceQ, opDeleteQ, opIncrementQ, opDecrementQ, opQuitQ, opFlushQ, opAppendQ, opPrependQ:
+		return true
+	}
+	return false
+}
+
+func processBinaryGet(w *bufio.Writer, cache ybc.Cacher, h binaryHeader, key []byte, sendKey bool) bool {
+	item, err := cache.GetItem(key)
+	if err != nil {
+		if err == ybc.ErrNotFound {
+			if isQuiet(h.opcode) {
+				return true
+			}
+			return writeBinaryError(w, h.opcode, statusKeyNotFound, h.opaque, "Not found")
+		}
+		log.Fatalf("Unexpected error returned by cache.GetItem(): [%s]", err)
+	}
+	defer item.Close()
+
+	extras := make([]byte, 4)
+	var respKey []byte
+	if sendKey {
+		respKey = key
+	}
+	if !writeBinaryHeader(w, h.opcode, statusNoError, h.opaque, 0, extras, respKey, item.Size()) {
+		return false
+	}
+	n, err := item.WriteTo(w)
+	if err != nil {
+		log.Printf("Error when streaming value for key=[%s]: [%s]", key, err)
+		return false
+	}
+	if n != int64(item.Size()) {
+		log.Printf("Invalid length of payload=[%d]. Expected [%d]", n, item.Size())
+		return false
+	}
+	return true
+}
+
+func processBinaryStore(w *bufio.Writer, r *bufio.Reader, cache ybc.Cacher, cases *casTable, h binaryHeader, extras, key []byte, valueLen int) bool {
+	if len(extras) != binaryFlagsExtrasSize {
+		io.CopyN(io.Discard, r, int64(valueLen))
+		return writeBinaryError(w, h.opcode, statusInvalidArguments, h.opaque, "Invalid extras")
+	}
+	exptimeSecs := binary.BigEndian.Uint32(extras[4:8])
+	exptime := ybc.MaxTtl
+	if exptimeSecs != 0 {
+		exptime = time.Duration(exptimeSecs) * time.Second
+	}
+
+	switch h.opcode {
+	case opAdd, opAddQ:
+		item, err := cache.GetItem(key)
+		if err == nil {
+			item.Close()
+			io.CopyN(io.Discard, r, int64(valueLen))
+			return writeBinaryError(w, h.opcode, statusKeyExists, h.opaque, "Already exists")
+		}
+	case opReplace, opReplaceQ:
+		item, err := cache.GetItem(key)
+		if err != nil {
+			io.CopyN(io.Discard, r, int64(valueLen))
+			return writeBinaryError(w, h.opcode, statusKeyNotFound, h.opaque, "Not found")
+		}
+		item.Close()
+	}
+
+	// A non-zero h.cas requests a CAS-conditional store: it must match
+	// the key's current CAS, the same check processCasCmd makes for
+	// the text protocol's 'cas' command.
+	if h.cas != 0 && cases.get(key) != h.cas {
+		io.CopyN(io.Discard, r, int64(valueLen))
+		return writeBinaryError(w, h.opcode, statusKeyExists, h.opaque, "CAS mismatch")
+	}
+
+	txn, err := cache.NewSetTxn(key, valueLen, exptime)
+	if err != nil {
+		log.Printf("Cannot start 'set' transaction for key=[%s], size=[%d]: [%s]", key, valueLen, err)
+		io.CopyN(io.Discard, r, int64(valueLen))
+		return writeBinaryError(w, h.opcode, statusOutOfMemory, h.opaque, "Cannot start transaction")
+	}
+	n, err := txn.ReadFrom(io.LimitReader(r, int64(valueLen)))
+	if err != nil || n != int64(valueLen) {
+		txn.Commit()
+		return writeBinaryError(w, h.opcode, statusInvalidArguments, h.opaque, "Error reading value")
+	}
+	txn.Commit()
+	cas := cases.bump(key)
+	if isQuiet(h.opcode) {
+		return true
+	}
+	return writeBinaryResponse(w, h.opcode, statusNoError, h.opaque, cas, nil, nil, nil)
+}
+
+func processBinaryDelete(w *bufio.Writer, cache ybc.Cacher, cases *casTable, h binaryHeader, key []byte) bool {
+	if !cache.Delete(key) {
+		if isQuiet(h.opcode) {
+			return true
+		}
+		return writeBinaryError(w, h.opcode, statusKeyNotFound, h.opaque, "Not found")
+	}
+	cases.del(key)
+	if isQuiet(h.opcode) {
+		return true
+	}
+	return writeBinaryResponse(w, h.opcode, statusNoError, h.opaque, 0, nil, nil, nil)
+}
+
+func processBinaryIncrDecr(w *bufio.Writer, r *bufio.Reader, cache ybc.Cacher, locks *keyLockTable, h binaryHeader, extras, key []byte, valueLen int) bool {
+	io.CopyN(io.Discard, r, int64(valueLen))
+	if len(extras) != binaryIncrDecrExtrasSize {
+		return writeBinaryError(w, h.opcode, statusInvalidArguments, h.opaque, "Invalid extras")
+	}
+	delta := binary.BigEndian.Uint64(extras[0:8])
+	initial := binary.BigEndian.Uint64(extras[8:16])
+	exptimeSecs := binary.BigEndian.Uint32(extras[16:20])
+
+	mu := locks.Lock(key)
+	defer mu.Unlock()
+
+	var n uint64
+	item, err := cache.GetItem(key)
+	if err == nil {
+		var buf bytes.Buffer
+		_, rerr := item.WriteTo(&buf)
+		item.Close()
+		if rerr != nil {
+			return writeBinaryError(w, h.opcode, statusNonNumericValue, h.opaque, "Error reading value")
+		}
+		n, err = strconv.ParseUint(strings.TrimSpace(buf.String()), 10, 64)
+		if err != nil {
+			return writeBinaryError(w, h.opcode, statusNonNumericValue, h.opaque, "Non-numeric value")
+		}
+	} else if err == ybc.ErrNotFound {
+		n = initial
+		exptime := ybc.MaxTtl
+		if exptimeSecs != 0xFFFFFFFF && exptimeSecs != 0 {
+			exptime = time.Duration(exptimeSecs) * time.Second
+		}
+		if !storeUint(cache, key, n, exptime) {
+			return writeBinaryError(w, h.opcode, statusOutOfMemory, h.opaque, "Cannot store initial value")
+		}
+		if isQuiet(h.opcode) {
+			return true
+		}
+		return writeBinaryIncrDecrResponse(w, h.opcode, h.opaque, n)
+	} else {
+		log.Fatalf("Unexpected error returned by cache.GetItem(): [%s]", err)
+	}
+
+	if h.opcode == opIncrement || h.opcode == opIncrementQ {
+		n += delta
+	} else {
+		if delta > n {
+			n = 0
+		} else {
+			n -= delta
+		}
+	}
+	// Deviates from memcached here: incrementing/decrementing an
+	// existing key re-creates the item with ybc.MaxTtl instead of
+	// preserving whatever exptime it already had, since the ybc
+	// binding doesn't expose a per-item remaining-ttl query to carry
+	// forward (see cmdTtl in the resp package for the same
+	// limitation).
+	if !storeUint(cache, key, n, ybc.MaxTtl) {
+		return writeBinaryError(w, h.opcode, statusOutOfMemory, h.opaque, "Cannot store value")
+	}
+	if isQuiet(h.opcode) {
+		return true
+	}
+	return writeBinaryIncrDecrResponse(w, h.opcode, h.opaque, n)
+}
+
+func writeBinaryIncrDecrResponse(w *bufio.Writer, opcode byte, opaque uint32, n uint64) bool {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, n)
+	return writeBinaryResponse(w, opcode, statusNoError, opaque, 0, nil, nil, value)
+}
+
+func storeUint(cache ybc.Cacher, key []byte, n uint64, exptime time.Duration) bool {
+	value := []byte(strconv.FormatUint(n, 10))
+	txn, err := cache.NewSetTxn(key, len(value), exptime)
+	if err != nil {
+		log.Printf("Cannot start transaction for key=[%s]: [%s]", key, err)
+		return false
+	}
+	defer txn.Commit()
+	_, err = txn.Write(value)
+	return err == nil
+}
+
+func processBinaryAppendPrepend(w *bufio.Writer, r *bufio.Reader, cache ybc.Cacher, h binaryHeader, key []byte, valueLen int) bool {
+	newData := make([]byte, valueLen)
+	if _, err := io.ReadFull(r, newData); err != nil {
+		return writeBinaryError(w, h.opcode, statusInvalidArguments, h.opaque, "Error reading value")
+	}
+	item, err := cache.GetItem(key)
+	if err != nil {
+		if err == ybc.ErrNotFound {
+			if isQuiet(h.opcode) {
+				return true
+			}
+			return writeBinaryError(w, h.opcode, statusItemNotStored, h.opaque, "Not found")
+		}
+		log.Fatalf("Unexpected error returned by cache.GetItem(): [%s]", err)
+	}
+	var oldBuf bytes.Buffer
+	_, rerr := item.WriteTo(&oldBuf)
+	item.Close()
+	if rerr != nil {
+		return writeBinaryError(w, h.opcode, statusInvalidArguments, h.opaque, "Error reading value")
+	}
+
+	var combined []byte
+	if h.opcode == opAppend || h.opcode == opAppendQ {
+		combined = append(oldBuf.Bytes(), newData...)
+	} else {
+		combined = append(newData, oldBuf.Bytes()...)
+	}
+	// Deviates from memcached here: append/prepend re-creates the item
+	// with ybc.MaxTtl instead of preserving whatever exptime it
+	// already had, since the ybc binding doesn't expose a per-item
+	// remaining-ttl query to carry forward (see cmdTtl in the resp
+	// package for the same limitation).
+	txn, err := cache.NewSetTxn(key, len(combined), ybc.MaxTtl)
+	if err != nil {
+		log.Printf("Cannot start transaction for key=[%s]: [%s]", key, err)
+		return writeBinaryError(w, h.opcode, statusOutOfMemory, h.opaque, "Cannot start transaction")
+	}
+	_, err = txn.Write(combined)
+	txn.Commit()
+	if err != nil {
+		return writeBinaryError(w, h.opcode, statusInvalidArguments, h.opaque, "Error writing value")
+	}
+	if isQuiet(h.opcode) {
+		return true
+	}
+	return writeBinaryResponse(w, h.opcode, statusNoError, h.opaque, 0, nil, nil, nil)
+}
+
+// processBinaryRequest reads and handles a single binary protocol
+// command. It returns false when the connection should be closed,
+// either because of a protocol error or because the client sent Quit.
+func processBinaryRequest(r *bufio.Reader, w *bufio.Writer, cache ybc.Cacher, locks *keyLockTable, cases *casTable) bool {
+	h, ok := readBinaryHeader(r)
+	if !ok {
+		return false
+	}
+	extras, key, valueLen, ok := readBinaryBody(r, h)
+	if !ok {
+		return false
+	}
+
+	switch h.opcode {
+	case opGet, opGetQ:
+		return processBinaryGet(w, cache, h, key, false)
+	case opGetK, opGetKQ:
+		return processBinaryGet(w, cache, h, key, true)
+	case opSet, opSetQ, opAdd, opAddQ, opReplace, opReplaceQ:
+		return processBinaryStore(w, r, cache, cases, h, extras, key, valueLen)
+	case opDelete, opDeleteQ:
+		return processBinaryDelete(w, cache, cases, h, key)
+	case opIncrement, opIncrementQ, opDecrement, opDecrementQ:
+		return processBinaryIncrDecr(w, r, cache, locks, h, extras, key, valueLen)
+	case opAppend, opAppendQ, opPrepend, opPrependQ:
+		return processBinaryAppendPrepend(w, r, cache, h, key, valueLen)
+	case opNoop:
+		return writeBinaryResponse(w, h.opcode, statusNoError, h.opaque, 0, nil, nil, nil)
+	case opVersion:
+		return writeBinaryResponse(w, h.opcode, statusNoError, h.opaque, 0, nil, nil, []byte("ybc"))
+	case opFlush, opFlushQ:
+		io.CopyN(io.Discard, r, int64(valueLen))
+		cache.Clear()
+		if isQuiet(h.opcode) {
+			return true
+		}
+		return writeBinaryResponse(w, h.opcode, statusNoError, h.opaque, 0, nil, nil, nil)
+	case opStat:
+		// A real stats dump needs the Server's counters, which aren't
+		// reachable from here; report an empty stat list (a single
+		// Noop-style terminating packet) like memcached does when it
+		// has nothing to add.
+		return writeBinaryResponse(w, h.opcode, statusNoError, h.opaque, 0, nil, nil, nil)
+	case opQuit, opQuitQ:
+		if !isQuiet(h.opcode) {
+			writeBinaryResponse(w, h.opcode, statusNoError, h.opaque, 0, nil, nil, nil)
+		}
+		return false
+	default:
+		io.CopyN(io.Discard, r, int64(valueLen))
+		return writeBinaryError(w, h.opcode, statusUnknownCommand, h.opaque, "Unknown command")
+	}
+}
+
+func handleBinaryConn(r *bufio.Reader, w *bufio.Writer, cache ybc.Cacher, locks *keyLockTable, cases *casTable) {
+	for {
+		if !processBinaryRequest(r, w, cache, locks, cases) {
+			break
+		}
+		if r.Buffered() == 0 {
+			w.Flush()
+		}
+	}
+}
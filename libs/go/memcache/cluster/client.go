@@ -0,0 +1,107 @@
+package cluster
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clientGet issues a 'get' command and reads back its single VALUE
+// line (or a miss), speaking the same text protocol as the memcache
+// server in the parent package.
+func clientGet(conn net.Conn, key []byte) (value []byte, found bool, err error) {
+	if _, err = fmt.Fprintf(conn, "get %s\r\n", key); err != nil {
+		return nil, false, err
+	}
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, false, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "END" {
+		return nil, false, nil
+	}
+	fields := bytes.Fields([]byte(line))
+	// The server appends a cas token to every VALUE line, so accept
+	// both "VALUE key flags size" and "VALUE key flags size cas".
+	if (len(fields) != 4 && len(fields) != 5) || string(fields[0]) != "VALUE" {
+		return nil, false, fmt.Errorf("cluster: unexpected 'get' response line=[%s]", line)
+	}
+	size, err := strconv.Atoi(string(fields[2]))
+	if err != nil {
+		return nil, false, err
+	}
+	value = make([]byte, size)
+	if _, err = readFullFrom(r, value); err != nil {
+		return nil, false, err
+	}
+	if _, err = r.ReadString('\n'); err != nil { // trailing crlf after value
+		return nil, false, err
+	}
+	if _, err = r.ReadString('\n'); err != nil { // END\r\n
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// clientSet issues a 'set' command storing value under key with the
+// given ttl and waits for STORED.
+func clientSet(conn net.Conn, key []byte, value []byte, ttl time.Duration) error {
+	exptime := int(ttl / time.Second)
+	if _, err := fmt.Fprintf(conn, "set %s 0 %d %d\r\n", key, exptime, len(value)); err != nil {
+		return err
+	}
+	if _, err := conn.Write(value); err != nil {
+		return err
+	}
+	if _, err := conn.Write([]byte("\r\n")); err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if strings.TrimRight(line, "\r\n") != "STORED" {
+		return fmt.Errorf("cluster: unexpected 'set' response line=[%s]", line)
+	}
+	return nil
+}
+
+// clientPing probes a node's liveness the same way the health checker
+// does: issuing 'version' and expecting a VERSION line back.
+func clientPing(conn net.Conn, timeout time.Duration) error {
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+	if _, err := conn.Write([]byte("version\r\n")); err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix([]byte(line), []byte("VERSION")) {
+		return fmt.Errorf("cluster: unexpected 'version' response line=[%s]", line)
+	}
+	return nil
+}
+
+func readFullFrom(r *bufio.Reader, buf []byte) (int, error) {
+	read := 0
+	for read < len(buf) {
+		n, err := r.Read(buf[read:])
+		read += n
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
@@ -0,0 +1,330 @@
+// Package cluster provides a client-side sharded view over multiple
+// memcache servers (see the parent memcache package), routing each key
+// to a node via a Ketama-style consistent-hash ring so that adding or
+// removing nodes reshuffles only a small fraction of keys.
+package cluster
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// errNoNodes is returned when the ring has no nodes to route to,
+// e.g. before Start is called or after every node has been removed.
+var errNoNodes = errors.New("cluster: no nodes available")
+
+// Node describes a single memcache server and how many virtual points
+// it gets on the ring relative to its peers.
+type Node struct {
+	Addr   string
+	Weight int
+}
+
+// ClusterClient mirrors the Start/Stop lifecycle of memcache.Server:
+// configure the exported fields, call Start, and Stop when done.
+type ClusterClient struct {
+	// Nodes is the initial set of servers to route to. Use AddNode/
+	// RemoveNode afterwards, or AutoDiscover, to change membership.
+	Nodes []Node
+
+	// MinIdlePerNode/MaxIdlePerNode bound each node's connection pool.
+	MinIdlePerNode int
+	MaxIdlePerNode int
+
+	DialTimeout time.Duration
+	WaitTimeout time.Duration
+
+	// HealthCheckInterval, if non-zero, periodically probes every
+	// node; unreachable nodes are quarantined (pulled off the ring)
+	// until a later probe succeeds.
+	HealthCheckInterval time.Duration
+
+	// AutoDiscover, if set, is called every DiscoverInterval to fetch
+	// the current endpoint list from whatever service discovery the
+	// caller runs; the ring is reconciled to match.
+	AutoDiscover     func() ([]Node, error)
+	DiscoverInterval time.Duration
+
+	mu          sync.RWMutex
+	ring        *ring
+	pools       map[string]*connPool
+	quarantined map[string]bool
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// Start builds the ring and connection pools for the initial node set
+// and launches the health-check/auto-discovery loops, if configured.
+func (cc *ClusterClient) Start() {
+	cc.ring = newRing()
+	cc.pools = make(map[string]*connPool)
+	cc.quarantined = make(map[string]bool)
+	cc.stopCh = make(chan struct{})
+
+	for _, n := range cc.Nodes {
+		cc.addNodeLocked(n)
+	}
+
+	if cc.HealthCheckInterval > 0 {
+		cc.wg.Add(1)
+		go cc.healthCheckLoop()
+	}
+	if cc.AutoDiscover != nil {
+		cc.wg.Add(1)
+		go cc.discoverLoop()
+	}
+}
+
+// Stop halts the background loops and closes every pooled connection.
+func (cc *ClusterClient) Stop() {
+	close(cc.stopCh)
+	cc.wg.Wait()
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	for _, p := range cc.pools {
+		p.closeAll()
+	}
+}
+
+func (cc *ClusterClient) addNodeLocked(n Node) {
+	cc.ring.AddNode(n.Addr, n.Weight)
+	if _, ok := cc.pools[n.Addr]; !ok {
+		cc.pools[n.Addr] = newConnPool(n.Addr, cc.MinIdlePerNode, cc.MaxIdlePerNode, cc.DialTimeout, cc.WaitTimeout)
+	}
+}
+
+// AddNode adds (or re-weights) a node at runtime.
+func (cc *ClusterClient) AddNode(n Node) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.addNodeLocked(n)
+	// Record the node in Nodes too, so a health-check recovery can
+	// find its weight and put it back on the ring.
+	for i := range cc.Nodes {
+		if cc.Nodes[i].Addr == n.Addr {
+			cc.Nodes[i] = n
+			return
+		}
+	}
+	cc.Nodes = append(cc.Nodes, n)
+}
+
+// RemoveNode drops a node and closes its pooled connections.
+func (cc *ClusterClient) RemoveNode(addr string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.ring.RemoveNode(addr)
+	delete(cc.quarantined, addr)
+	if p, ok := cc.pools[addr]; ok {
+		p.closeAll()
+		delete(cc.pools, addr)
+	}
+}
+
+func (cc *ClusterClient) poolFor(addr string) *connPool {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+	return cc.pools[addr]
+}
+
+func (cc *ClusterClient) nodeFor(key []byte) (string, bool) {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+	if cc.ring == nil {
+		return "", false
+	}
+	return cc.ring.Get(key)
+}
+
+// Get fetches key from whichever node the ring routes it to.
+func (cc *ClusterClient) Get(key []byte) (value []byte, found bool, err error) {
+	addr, ok := cc.nodeFor(key)
+	if !ok {
+		return nil, false, errNoNodes
+	}
+	pool := cc.poolFor(addr)
+	conn, err := pool.get()
+	if err != nil {
+		return nil, false, err
+	}
+	value, found, err = clientGet(conn, key)
+	pool.put(conn, err == nil)
+	return value, found, err
+}
+
+// Set stores value under key with the given ttl on whichever node the
+// ring routes it to.
+func (cc *ClusterClient) Set(key []byte, value []byte, ttl time.Duration) error {
+	addr, ok := cc.nodeFor(key)
+	if !ok {
+		return errNoNodes
+	}
+	pool := cc.poolFor(addr)
+	conn, err := pool.get()
+	if err != nil {
+		return err
+	}
+	err = clientSet(conn, key, value, ttl)
+	pool.put(conn, err == nil)
+	return err
+}
+
+// MultiGet groups keys by node and issues one connection's worth of
+// concurrent per-node requests, returning whatever was found. A node
+// that errors out contributes only the keys it returned before the
+// error, rather than failing the whole call.
+func (cc *ClusterClient) MultiGet(keys [][]byte) map[string][]byte {
+	byNode := make(map[string][][]byte)
+	for _, key := range keys {
+		addr, ok := cc.nodeFor(key)
+		if !ok {
+			continue
+		}
+		byNode[addr] = append(byNode[addr], key)
+	}
+
+	results := make(map[string][]byte)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for addr, nodeKeys := range byNode {
+		wg.Add(1)
+		go func(addr string, nodeKeys [][]byte) {
+			defer wg.Done()
+			pool := cc.poolFor(addr)
+			conn, err := pool.get()
+			if err != nil {
+				return
+			}
+			healthy := true
+			for _, key := range nodeKeys {
+				value, found, err := clientGet(conn, key)
+				if err != nil {
+					healthy = false
+					break
+				}
+				if found {
+					mu.Lock()
+					results[string(key)] = value
+					mu.Unlock()
+				}
+			}
+			pool.put(conn, healthy)
+		}(addr, nodeKeys)
+	}
+	wg.Wait()
+	return results
+}
+
+func (cc *ClusterClient) healthCheckLoop() {
+	defer cc.wg.Done()
+	ticker := time.NewTicker(cc.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cc.stopCh:
+			return
+		case <-ticker.C:
+			cc.probeAll()
+		}
+	}
+}
+
+func (cc *ClusterClient) probeAll() {
+	cc.mu.RLock()
+	addrs := make([]string, 0, len(cc.pools))
+	for addr := range cc.pools {
+		addrs = append(addrs, addr)
+	}
+	cc.mu.RUnlock()
+
+	for _, addr := range addrs {
+		alive := cc.probe(addr)
+		cc.mu.Lock()
+		wasQuarantined := cc.quarantined[addr]
+		switch {
+		case !alive && !wasQuarantined:
+			cc.quarantined[addr] = true
+			cc.ring.RemoveNode(addr)
+			log.Printf("cluster: quarantining unreachable node=[%s]", addr)
+		case alive && wasQuarantined:
+			delete(cc.quarantined, addr)
+			for _, n := range cc.Nodes {
+				if n.Addr == addr {
+					cc.ring.AddNode(n.Addr, n.Weight)
+					break
+				}
+			}
+			log.Printf("cluster: node=[%s] recovered, returning it to the ring", addr)
+		}
+		cc.mu.Unlock()
+	}
+}
+
+func (cc *ClusterClient) probe(addr string) bool {
+	pool := cc.poolFor(addr)
+	if pool == nil {
+		return false
+	}
+	conn, err := pool.get()
+	if err != nil {
+		return false
+	}
+	err = clientPing(conn, cc.DialTimeout)
+	pool.put(conn, err == nil)
+	return err == nil
+}
+
+func (cc *ClusterClient) discoverLoop() {
+	defer cc.wg.Done()
+	interval := cc.DiscoverInterval
+	if interval <= 0 {
+		interval = cc.HealthCheckInterval
+	}
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cc.stopCh:
+			return
+		case <-ticker.C:
+			nodes, err := cc.AutoDiscover()
+			if err != nil {
+				log.Printf("cluster: AutoDiscover failed: [%s]", err)
+				continue
+			}
+			cc.syncNodes(nodes)
+		}
+	}
+}
+
+// syncNodes reconciles the ring/pools with a freshly discovered
+// endpoint list: new nodes are added, nodes no longer present are
+// removed.
+func (cc *ClusterClient) syncNodes(nodes []Node) {
+	want := make(map[string]Node, len(nodes))
+	for _, n := range nodes {
+		want[n.Addr] = n
+	}
+
+	cc.mu.Lock()
+	cc.Nodes = nodes
+	for addr := range cc.pools {
+		if _, ok := want[addr]; !ok {
+			cc.ring.RemoveNode(addr)
+			delete(cc.quarantined, addr)
+			cc.pools[addr].closeAll()
+			delete(cc.pools, addr)
+		}
+	}
+	for _, n := range nodes {
+		cc.addNodeLocked(n)
+	}
+	cc.mu.Unlock()
+}
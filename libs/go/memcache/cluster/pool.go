@@ -0,0 +1,113 @@
+package cluster
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// errPoolTimeout is returned by connPool.get when no connection
+// becomes available within WaitTimeout.
+var errPoolTimeout = errors.New("cluster: timed out waiting for an idle connection")
+
+// connPool is a small bounded connection pool for a single node,
+// following the same semaphore-gated-accept pattern Server.run() uses
+// to enforce MaxConnections: a buffered channel caps the number of
+// connections ever open at once, and a second channel holds the idle
+// ones.
+type connPool struct {
+	addr        string
+	dialTimeout time.Duration
+	waitTimeout time.Duration
+	open        chan struct{}
+	idle        chan net.Conn
+}
+
+func newConnPool(addr string, minIdle, maxIdle int, dialTimeout, waitTimeout time.Duration) *connPool {
+	if maxIdle <= 0 {
+		maxIdle = 1
+	}
+	p := &connPool{
+		addr:        addr,
+		dialTimeout: dialTimeout,
+		waitTimeout: waitTimeout,
+		open:        make(chan struct{}, maxIdle),
+		idle:        make(chan net.Conn, maxIdle),
+	}
+	for i := 0; i < minIdle && i < maxIdle; i++ {
+		conn, err := p.dial()
+		if err != nil {
+			break
+		}
+		p.open <- struct{}{}
+		p.idle <- conn
+	}
+	return p
+}
+
+func (p *connPool) dial() (net.Conn, error) {
+	if p.dialTimeout > 0 {
+		return net.DialTimeout("tcp", p.addr, p.dialTimeout)
+	}
+	return net.Dial("tcp", p.addr)
+}
+
+// get returns an idle connection, opens a fresh one if the pool hasn't
+// hit its cap yet, or waits up to WaitTimeout for one to free up.
+func (p *connPool) get() (net.Conn, error) {
+	select {
+	case conn := <-p.idle:
+		return conn, nil
+	default:
+	}
+
+	select {
+	case p.open <- struct{}{}:
+		conn, err := p.dial()
+		if err != nil {
+			<-p.open
+			return nil, err
+		}
+		return conn, nil
+	default:
+	}
+
+	timer := time.NewTimer(p.waitTimeout)
+	defer timer.Stop()
+	select {
+	case conn := <-p.idle:
+		return conn, nil
+	case <-timer.C:
+		return nil, errPoolTimeout
+	}
+}
+
+// put returns conn to the idle pool, or closes it (and frees its slot)
+// if it's no longer healthy or the idle pool is already full.
+func (p *connPool) put(conn net.Conn, healthy bool) {
+	if !healthy {
+		conn.Close()
+		<-p.open
+		return
+	}
+	select {
+	case p.idle <- conn:
+	default:
+		conn.Close()
+		<-p.open
+	}
+}
+
+// closeAll drains and closes every idle connection, e.g. when a node
+// is removed from the cluster.
+func (p *connPool) closeAll() {
+	for {
+		select {
+		case conn := <-p.idle:
+			conn.Close()
+			<-p.open
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package cluster
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// virtualNodesPerWeight is the number of ring points a node with
+// weight 1 gets, Ketama-style. A node with weight N gets N times as
+// many points, proportionally increasing the share of keys it's
+// responsible for.
+const virtualNodesPerWeight = 160
+
+type ringPoint struct {
+	hash uint32
+	addr string
+}
+
+// ring is a consistent-hash ring over a set of weighted nodes. A key
+// is routed to the node owning the first ring point at or after the
+// key's hash, wrapping around to the first point if the key hashes
+// past every point.
+type ring struct {
+	mu      sync.RWMutex
+	weights map[string]int
+	points  []ringPoint
+}
+
+func newRing() *ring {
+	return &ring{weights: make(map[string]int)}
+}
+
+func ringHash(b []byte) uint32 {
+	return crc32.ChecksumIEEE(b)
+}
+
+// AddNode inserts or re-weights a node and rebuilds the ring.
+func (r *ring) AddNode(addr string, weight int) {
+	if weight <= 0 {
+		weight = 1
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.weights[addr] = weight
+	r.rebuildLocked()
+}
+
+// RemoveNode drops a node and rebuilds the ring.
+func (r *ring) RemoveNode(addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.weights[addr]; !ok {
+		return
+	}
+	delete(r.weights, addr)
+	r.rebuildLocked()
+}
+
+func (r *ring) rebuildLocked() {
+	points := make([]ringPoint, 0, len(r.weights)*virtualNodesPerWeight)
+	for addr, weight := range r.weights {
+		count := virtualNodesPerWeight * weight
+		for i := 0; i < count; i++ {
+			h := ringHash([]byte(addr + "-" + strconv.Itoa(i)))
+			points = append(points, ringPoint{hash: h, addr: addr})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+	r.points = points
+}
+
+// Get returns the node owning key, or ok=false if the ring is empty.
+func (r *ring) Get(key []byte) (addr string, ok bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.points) == 0 {
+		return "", false
+	}
+	h := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].addr, true
+}
+
+// Nodes returns the distinct node addresses currently on the ring.
+func (r *ring) Nodes() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	addrs := make([]string, 0, len(r.weights))
+	for addr := range r.weights {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
@@ -0,0 +1,188 @@
+package memcache
+
+import (
+	"bufio"
+	"errors"
+	"log"
+
+	"github.com/valyala/ybc/bindings/go/ybc"
+)
+
+// errHandlerFailed is returned by a HandlerFunc when the underlying
+// processXxxCmd already logged the failure (and attempted to write an
+// error response); the connection should be closed.
+var errHandlerFailed = errors.New("memcache: command handler failed")
+
+// errQuit is returned by the 'quit' handler to close the connection
+// gracefully, without logging anything.
+var errQuit = errors.New("memcache: quit")
+
+// CmdContext carries one already-parsed command and the server-wide
+// state a HandlerFunc needs to serve it: the connection's buffered
+// reader/writer, the shared cache, and the key-lock/CAS/stats tables
+// the built-in handlers rely on.
+type CmdContext struct {
+	Conn       *bufio.ReadWriter
+	Cache      ybc.Cacher
+	Verb       string
+	Args       []byte
+	Locks      *keyLockTable
+	Cases      *casTable
+	Stats      *serverStats
+	RemoteAddr string
+
+	cmd           *setCmd
+	authenticated *bool
+}
+
+// HandlerFunc serves one already-parsed command. It returns nil to
+// keep the connection open for the next command, errQuit to close it
+// gracefully, or any other error to close it after the failure has
+// already been reported to the client.
+type HandlerFunc func(ctx *CmdContext) error
+
+// Middleware wraps a HandlerFunc to add behaviour around every
+// text-protocol command - logging, rate limiting, auth, metrics - without editing
+// the handlers themselves. See NewRateLimitMiddleware,
+// NewPrometheusMiddleware and NewAuthMiddleware for built-ins.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// splitVerb splits a command line into its verb and the remainder of
+// the line, the same way the old HasPrefix cascade sliced past "get ",
+// "delete ", etc. A line with no space is a bare verb with no args.
+func splitVerb(line []byte) (verb, args []byte) {
+	for i, b := range line {
+		if b == ' ' {
+			return line[:i], line[i+1:]
+		}
+	}
+	return line, nil
+}
+
+// defaultHandlers is the out-of-the-box verb table; Server.init()
+// copies it into Handlers for any verb the caller hasn't already
+// registered, so a custom Handlers entry always wins.
+var defaultHandlers = map[string]HandlerFunc{
+	"get":       handleGet(false),
+	"gets":      handleGet(true),
+	"set":       handleSet,
+	"add":       handleAddReplace(addMode),
+	"replace":   handleAddReplace(replaceMode),
+	"cas":       handleCas,
+	"delete":    handleDelete,
+	"incr":      handleIncrDecr(true),
+	"decr":      handleIncrDecr(false),
+	"append":    handleAppendPrepend(false),
+	"prepend":   handleAppendPrepend(true),
+	"flush_all": handleFlushAll,
+	"stats":     handleStats,
+	"version":   handleVersion,
+	"quit":      handleQuit,
+}
+
+func handleGet(withCas bool) HandlerFunc {
+	return func(ctx *CmdContext) error {
+		if !processGetCmd(ctx.Conn, ctx.Cache, ctx.Args, ctx.Cases, withCas, ctx.Stats) {
+			return errHandlerFailed
+		}
+		return nil
+	}
+}
+
+func handleSet(ctx *CmdContext) error {
+	if !processSetCmd(ctx.Conn, ctx.Cache, ctx.Args, ctx.cmd, ctx.Cases, ctx.Stats) {
+		return errHandlerFailed
+	}
+	return nil
+}
+
+func handleAddReplace(mode addOrReplaceMode) HandlerFunc {
+	return func(ctx *CmdContext) error {
+		if !processAddReplaceCmd(ctx.Conn, ctx.Cache, ctx.Args, ctx.cmd, mode, ctx.Cases, ctx.Stats) {
+			return errHandlerFailed
+		}
+		return nil
+	}
+}
+
+func handleCas(ctx *CmdContext) error {
+	if !processCasCmd(ctx.Conn, ctx.Cache, ctx.Args, ctx.Cases, ctx.Stats) {
+		return errHandlerFailed
+	}
+	return nil
+}
+
+func handleDelete(ctx *CmdContext) error {
+	if !processDeleteCmd(ctx.Conn, ctx.Cache, ctx.Args, ctx.Cases) {
+		return errHandlerFailed
+	}
+	return nil
+}
+
+func handleIncrDecr(increment bool) HandlerFunc {
+	return func(ctx *CmdContext) error {
+		if !incrOrDecr(ctx.Conn, ctx.Cache, ctx.Args, ctx.Locks, ctx.Cases, increment) {
+			return errHandlerFailed
+		}
+		return nil
+	}
+}
+
+func handleAppendPrepend(prepend bool) HandlerFunc {
+	return func(ctx *CmdContext) error {
+		if !processAppendPrependCmd(ctx.Conn, ctx.Cache, ctx.Args, ctx.cmd, prepend, ctx.Cases, ctx.Stats) {
+			return errHandlerFailed
+		}
+		return nil
+	}
+}
+
+func handleFlushAll(ctx *CmdContext) error {
+	if !processFlushAllCmd(ctx.Conn, ctx.Cache, ctx.Args) {
+		return errHandlerFailed
+	}
+	return nil
+}
+
+func handleStats(ctx *CmdContext) error {
+	if !processStatsCmd(ctx.Conn, ctx.Stats) {
+		return errHandlerFailed
+	}
+	return nil
+}
+
+func handleVersion(ctx *CmdContext) error {
+	if !processVersionCmd(ctx.Conn) {
+		return errHandlerFailed
+	}
+	return nil
+}
+
+func handleQuit(ctx *CmdContext) error {
+	return errQuit
+}
+
+// route looks up ctx.Verb in s.Handlers and calls it, or reports an
+// unrecognized command. Custom verbs (e.g. "touch", "lru_crawler") can
+// be served by adding an entry to Handlers before Start - no need to
+// touch this dispatch logic.
+func (s *Server) route(ctx *CmdContext) error {
+	h, ok := s.Handlers[ctx.Verb]
+	if !ok {
+		log.Printf("Unrecognized command=[%s]", ctx.Verb)
+		protocolError(ctx.Conn.Writer)
+		return errHandlerFailed
+	}
+	return h(ctx)
+}
+
+// buildDispatch wraps s.route with every registered middleware, in
+// the order they were added to Use - the first Use'd middleware is
+// outermost and sees each command first.
+func (s *Server) buildDispatch() HandlerFunc {
+	h := s.route
+	for i := len(s.middlewares) - 1; i >= 0; i-- {
+		h = s.middlewares[i](h)
+	}
+	return h
+}
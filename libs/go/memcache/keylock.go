@@ -0,0 +1,24 @@
+package memcache
+
+import "sync"
+
+// keyLockTable serializes the read-modify-write sequences that incr/
+// decr (both protocol frontends) need, since the ybc cache has no
+// atomic counter operation of its own. A fixed number of stripes keeps
+// lock contention low without allocating one mutex per key.
+const keyLockStripeCount = 256
+
+type keyLockTable struct {
+	stripes [keyLockStripeCount]sync.Mutex
+}
+
+func (t *keyLockTable) Lock(key []byte) *sync.Mutex {
+	h := uint32(2166136261)
+	for _, b := range key {
+		h ^= uint32(b)
+		h *= 16777619
+	}
+	m := &t.stripes[h%keyLockStripeCount]
+	m.Lock()
+	return m
+}
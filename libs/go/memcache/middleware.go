@@ -0,0 +1,146 @@
+package memcache
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// tokenBucket is a per-key token-bucket rate limiter: it holds at most
+// burst tokens, refilling at rate tokens/sec, and denies a request
+// when empty.
+type tokenBucket struct {
+	mu       sync.Mutex
+	tokens   float64
+	rate     float64
+	burst    float64
+	lastFill time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{tokens: burst, rate: rate, burst: burst, lastFill: time.Now()}
+}
+
+func (b *tokenBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.lastFill).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.lastFill = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// NewRateLimitMiddleware returns a Middleware that enforces a token
+// bucket per remote address: ratePerSecond tokens/sec refill, up to
+// burst tokens banked. A caller beyond its limit gets a client error
+// instead of reaching the handler.
+func NewRateLimitMiddleware(ratePerSecond, burst float64) Middleware {
+	var mu sync.Mutex
+	buckets := make(map[string]*tokenBucket)
+
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx *CmdContext) error {
+			host := remoteHost(ctx.RemoteAddr)
+
+			mu.Lock()
+			b, ok := buckets[host]
+			if !ok {
+				b = newTokenBucket(ratePerSecond, burst)
+				buckets[host] = b
+			}
+			mu.Unlock()
+
+			if !b.allow() {
+				clientError(ctx.Conn.Writer, "rate limit exceeded")
+				return nil
+			}
+			return next(ctx)
+		}
+	}
+}
+
+func remoteHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// NewPrometheusMiddleware returns a Middleware serving Prometheus text
+// exposition format on the "metrics" verb, reporting the same
+// cmd_get/cmd_set/hits/misses/bytes counters the 'stats' command
+// reports; every other command passes through unchanged.
+func NewPrometheusMiddleware() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx *CmdContext) error {
+			if ctx.Verb != "metrics" {
+				return next(ctx)
+			}
+			writePrometheusStats(ctx.Conn.Writer, ctx.Stats)
+			return nil
+		}
+	}
+}
+
+func writePrometheusStats(w *bufio.Writer, stats *serverStats) {
+	fmt.Fprintf(w, "# TYPE memcache_cmd_get_total counter\nmemcache_cmd_get_total %d\n", stats.cmdGet.Load())
+	fmt.Fprintf(w, "# TYPE memcache_cmd_set_total counter\nmemcache_cmd_set_total %d\n", stats.cmdSet.Load())
+	fmt.Fprintf(w, "# TYPE memcache_get_hits_total counter\nmemcache_get_hits_total %d\n", stats.getHits.Load())
+	fmt.Fprintf(w, "# TYPE memcache_get_misses_total counter\nmemcache_get_misses_total %d\n", stats.getMisses.Load())
+	fmt.Fprintf(w, "# TYPE memcache_bytes_read_total counter\nmemcache_bytes_read_total %d\n", stats.bytesRead.Load())
+	fmt.Fprintf(w, "# TYPE memcache_bytes_written_total counter\nmemcache_bytes_written_total %d\n", stats.bytesWritten.Load())
+}
+
+// NewAuthMiddleware returns a Middleware implementing a SASL
+// PLAIN-style gate: every command is rejected with a client error
+// until the connection issues "auth <user> <pass>\r\n" matching an
+// entry in creds. Meant for deployments where the text protocol port
+// is reachable by more than trusted internal callers. The gate covers
+// text-protocol connections only: binary-protocol connections bypass
+// the middleware chain and are not authenticated.
+func NewAuthMiddleware(creds map[string]string) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx *CmdContext) error {
+			if ctx.Verb == "auth" {
+				return handleAuth(ctx, creds)
+			}
+			if !*ctx.authenticated {
+				clientError(ctx.Conn.Writer, "authentication required")
+				return nil
+			}
+			return next(ctx)
+		}
+	}
+}
+
+func handleAuth(ctx *CmdContext, creds map[string]string) error {
+	fields := bytes.Fields(ctx.Args)
+	if len(fields) != 2 {
+		clientError(ctx.Conn.Writer, "auth requires a username and password")
+		return nil
+	}
+	user, pass := string(fields[0]), string(fields[1])
+	if want, ok := creds[user]; !ok || want != pass {
+		clientError(ctx.Conn.Writer, "authentication failed")
+		return nil
+	}
+	*ctx.authenticated = true
+	_, err := ctx.Conn.Write([]byte("OK\r\n"))
+	if err != nil {
+		log.Printf("Error when writing response: [%s]", err)
+		return errHandlerFailed
+	}
+	return nil
+}
@@ -3,11 +3,14 @@ package memcache
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"github.com/valyala/ybc/bindings/go/ybc"
+	"io"
 	"log"
 	"net"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -49,7 +52,7 @@ func protocolError(w *bufio.Writer) {
 	w.WriteString("ERROR\r\n")
 }
 
-func writeGetResponse(w *bufio.Writer, key []byte, item *ybc.Item) bool {
+func writeGetResponse(w *bufio.Writer, key []byte, item *ybc.Item, cas uint64) bool {
 	_, err := w.Write([]byte("VALUE "))
 	if err != nil {
 		log.Printf("Error when writing VALUE response: [%s]", err)
@@ -71,9 +74,19 @@ func writeGetResponse(w *bufio.Writer, key []byte, item *ybc.Item) bool {
 		log.Printf("Error when writing size=[%d] to 'get' response: [%s]", size, err)
 		return false
 	}
-	_, err = w.Write([]byte(" 0\r\n"))
+	_, err = w.Write([]byte(" "))
 	if err != nil {
-		log.Printf("Error when writing 0\\r\\n to 'get' response: [%s]", err)
+		log.Printf("Error when writing ' ' to 'get' response: [%s]", err)
+		return false
+	}
+	_, err = w.Write([]byte(strconv.FormatUint(cas, 10)))
+	if err != nil {
+		log.Printf("Error when writing cas=[%d] to 'get' response: [%s]", cas, err)
+		return false
+	}
+	_, err = w.Write([]byte("\r\n"))
+	if err != nil {
+		log.Printf("Error when writing \\r\\n to 'get' response: [%s]", err)
 		return false
 	}
 	n, err := item.WriteTo(w)
@@ -93,20 +106,32 @@ func writeGetResponse(w *bufio.Writer, key []byte, item *ybc.Item) bool {
 	return true
 }
 
-func getItemAndWriteResponse(w *bufio.Writer, cache ybc.Cacher, key []byte) bool {
+func getItemAndWriteResponse(w *bufio.Writer, cache ybc.Cacher, key []byte, cases *casTable, withCas bool, stats *serverStats) bool {
 	item, err := cache.GetItem(key)
 	if err != nil {
 		if err == ybc.ErrNotFound {
+			stats.getMisses.Add(1)
 			return true
 		}
 		log.Fatalf("Unexpected error returned by cache.GetItem(): [%s]", err)
 	}
 	defer item.Close()
+	stats.getHits.Add(1)
 
-	return writeGetResponse(w, key, item)
+	var cas uint64
+	if withCas {
+		cas = cases.get(key)
+	}
+	size := item.Size()
+	if !writeGetResponse(w, key, item, cas) {
+		return false
+	}
+	stats.bytesWritten.Add(int64(size))
+	return true
 }
 
-func processGetCmd(c *bufio.ReadWriter, cache ybc.Cacher, line []byte) bool {
+func processGetCmd(c *bufio.ReadWriter, cache ybc.Cacher, line []byte, cases *casTable, withCas bool, stats *serverStats) bool {
+	stats.cmdGet.Add(1)
 	last := -1
 	lineSize := len(line)
 	for last < lineSize {
@@ -121,7 +146,7 @@ func processGetCmd(c *bufio.ReadWriter, cache ybc.Cacher, line []byte) bool {
 			continue
 		}
 		key := line[first:last]
-		if !getItemAndWriteResponse(c.Writer, cache, key) {
+		if !getItemAndWriteResponse(c.Writer, cache, key, cases, withCas, stats) {
 			return false
 		}
 	}
@@ -172,7 +197,53 @@ func parseSetCmd(line []byte, cmd *setCmd) bool {
 	return n == len(line)
 }
 
-func processSetCmd(c *bufio.ReadWriter, cache ybc.Cacher, line []byte, cmd *setCmd) bool {
+// storePayload reads a size-byte value plus its trailing crlf off c
+// and stores it under key with the given exptime, bumping key's cas so
+// 'gets'/'cas' see the new value. It is shared by
+// set/add/replace/cas/append/prepend, which differ only in the
+// existence/cas checks performed before the payload is read.
+func storePayload(c *bufio.ReadWriter, cache ybc.Cacher, key []byte, size int, exptime time.Duration, cases *casTable, stats *serverStats) bool {
+	txn, err := cache.NewSetTxn(key, size, exptime)
+	if err != nil {
+		log.Printf("Cannot start 'set' transaction for key=[%s], size=[%d], exptime=[%d]: [%s]", key, size, exptime, err)
+		serverError(c.Writer, "cannot start 'set' transaction")
+		return false
+	}
+	defer txn.Commit()
+	n, err := txn.ReadFrom(c.Reader)
+	if err != nil {
+		log.Printf("Error when reading payload for key=[%s], size=[%d]: [%s]", key, size, err)
+		clientError(c.Writer, "cannot read payload")
+		return false
+	}
+	stats.bytesRead.Add(n)
+	if n != int64(size) {
+		log.Printf("Unexpected payload size=[%d]. Expected [%d]", n, size)
+		clientError(c.Writer, "unexpected payload size")
+		return false
+	}
+	if !readCrLf(c.Reader) {
+		clientError(c.Writer, "cannot read crlf after payload")
+		return false
+	}
+	cases.bump(key)
+	return true
+}
+
+// discardPayload reads and drops a size-byte value plus its trailing
+// crlf, for commands that must reject a request (NOT_STORED, EXISTS,
+// ...) only after the client has already started streaming the value.
+func discardPayload(c *bufio.ReadWriter, size int, stats *serverStats) bool {
+	if _, err := io.CopyN(io.Discard, c.Reader, int64(size)); err != nil {
+		log.Printf("Error when discarding payload of size=[%d]: [%s]", size, err)
+		return false
+	}
+	stats.bytesRead.Add(int64(size))
+	return readCrLf(c.Reader)
+}
+
+func processSetCmd(c *bufio.ReadWriter, cache ybc.Cacher, line []byte, cmd *setCmd, cases *casTable, stats *serverStats) bool {
+	stats.cmdSet.Add(1)
 	cmd.noreply = nil
 	if !parseSetCmd(line, cmd) {
 		clientError(c.Writer, "unrecognized 'set' command")
@@ -190,39 +261,429 @@ func processSetCmd(c *bufio.ReadWriter, cache ybc.Cacher, line []byte, cmd *setC
 		clientError(c.Writer, "invalid size")
 		return false
 	}
+	noreply, ok := parseNoreply(c.Writer, cmd.noreply)
+	if !ok {
+		return false
+	}
+	if !storePayload(c, cache, key, size, exptime, cases, stats) {
+		return false
+	}
+	if !noreply {
+		_, err := c.Write([]byte("STORED\r\n"))
+		if err != nil {
+			log.Printf("Error when writing response: [%s]", err)
+			return false
+		}
+	}
+	return true
+}
+
+// parseNoreply validates an already-tokenized noreply argument (nil if
+// absent) and reports whether it was given.
+func parseNoreply(w *bufio.Writer, tok []byte) (noreply, ok bool) {
+	if tok == nil {
+		return false, true
+	}
+	if !bytes.Equal(tok, []byte("noreply")) {
+		clientError(w, "unrecognized noreply")
+		return false, false
+	}
+	return true, true
+}
+
+// addOrReplaceMode selects whether processAddReplaceCmd enforces
+// key-absent (add) or key-present (replace) semantics.
+type addOrReplaceMode int
+
+const (
+	addMode addOrReplaceMode = iota
+	replaceMode
+)
+
+func processAddReplaceCmd(c *bufio.ReadWriter, cache ybc.Cacher, line []byte, cmd *setCmd, mode addOrReplaceMode, cases *casTable, stats *serverStats) bool {
+	stats.cmdSet.Add(1)
+	cmd.noreply = nil
+	if !parseSetCmd(line, cmd) {
+		clientError(c.Writer, "unrecognized command")
+		return false
+	}
+
+	key := cmd.key
+	exptime, ok := parseExptime(cmd.exptime)
+	if !ok {
+		clientError(c.Writer, "invalid exptime")
+		return false
+	}
+	size, ok := parseSize(cmd.size)
+	if !ok {
+		clientError(c.Writer, "invalid size")
+		return false
+	}
+	noreply, ok := parseNoreply(c.Writer, cmd.noreply)
+	if !ok {
+		return false
+	}
+
+	item, err := cache.GetItem(key)
+	exists := err == nil
+	if exists {
+		item.Close()
+	} else if err != ybc.ErrNotFound {
+		log.Fatalf("Unexpected error returned by cache.GetItem(): [%s]", err)
+	}
+
+	if (mode == addMode && exists) || (mode == replaceMode && !exists) {
+		if !discardPayload(c, size, stats) {
+			clientError(c.Writer, "cannot read payload")
+			return false
+		}
+		if !noreply {
+			_, err = c.Write([]byte("NOT_STORED\r\n"))
+			if err != nil {
+				log.Printf("Error when writing response: [%s]", err)
+				return false
+			}
+		}
+		return true
+	}
+
+	if !storePayload(c, cache, key, size, exptime, cases, stats) {
+		return false
+	}
+	if !noreply {
+		_, err = c.Write([]byte("STORED\r\n"))
+		if err != nil {
+			log.Printf("Error when writing response: [%s]", err)
+			return false
+		}
+	}
+	return true
+}
+
+type casCmd struct {
+	key       []byte
+	exptime   []byte
+	size      []byte
+	casUnique []byte
+	noreply   []byte
+}
+
+func parseCasCmd(line []byte, cmd *casCmd) bool {
+	n := -1
+
+	cmd.key, n = nextToken(line, n, "key")
+	if cmd.key == nil {
+		return false
+	}
+	flagsUnused, n := nextToken(line, n, "flags")
+	if flagsUnused == nil {
+		return false
+	}
+	cmd.exptime, n = nextToken(line, n, "exptime")
+	if cmd.exptime == nil {
+		return false
+	}
+	cmd.size, n = nextToken(line, n, "size")
+	if cmd.size == nil {
+		return false
+	}
+	cmd.casUnique, n = nextToken(line, n, "cas_unique")
+	if cmd.casUnique == nil {
+		return false
+	}
+
+	if n == len(line) {
+		return true
+	}
+
+	cmd.noreply, n = nextToken(line, n, "noreply")
+	if cmd.noreply == nil {
+		return false
+	}
+	return n == len(line)
+}
+
+func processCasCmd(c *bufio.ReadWriter, cache ybc.Cacher, line []byte, cases *casTable, stats *serverStats) bool {
+	stats.cmdSet.Add(1)
+	cmd := casCmd{}
+	if !parseCasCmd(line, &cmd) {
+		clientError(c.Writer, "unrecognized 'cas' command")
+		return false
+	}
+
+	key := cmd.key
+	exptime, ok := parseExptime(cmd.exptime)
+	if !ok {
+		clientError(c.Writer, "invalid exptime")
+		return false
+	}
+	size, ok := parseSize(cmd.size)
+	if !ok {
+		clientError(c.Writer, "invalid size")
+		return false
+	}
+	casUnique, err := strconv.ParseUint(string(cmd.casUnique), 10, 64)
+	if err != nil {
+		clientError(c.Writer, "invalid cas_unique")
+		return false
+	}
+	noreply, ok := parseNoreply(c.Writer, cmd.noreply)
+	if !ok {
+		return false
+	}
+
+	item, err := cache.GetItem(key)
+	exists := err == nil
+	if exists {
+		item.Close()
+	} else if err != ybc.ErrNotFound {
+		log.Fatalf("Unexpected error returned by cache.GetItem(): [%s]", err)
+	}
+
+	var reply string
+	switch {
+	case !exists:
+		reply = "NOT_FOUND\r\n"
+	case cases.get(key) != casUnique:
+		reply = "EXISTS\r\n"
+	}
+	if reply != "" {
+		if !discardPayload(c, size, stats) {
+			clientError(c.Writer, "cannot read payload")
+			return false
+		}
+		if !noreply {
+			if _, err := c.Write([]byte(reply)); err != nil {
+				log.Printf("Error when writing response: [%s]", err)
+				return false
+			}
+		}
+		return true
+	}
+
+	if !storePayload(c, cache, key, size, exptime, cases, stats) {
+		return false
+	}
+	if !noreply {
+		if _, err := c.Write([]byte("STORED\r\n")); err != nil {
+			log.Printf("Error when writing response: [%s]", err)
+			return false
+		}
+	}
+	return true
+}
+
+func processDeleteCmd(c *bufio.ReadWriter, cache ybc.Cacher, line []byte, cases *casTable) bool {
+	n := -1
+	key, n := nextToken(line, n, "key")
+	if key == nil {
+		clientError(c.Writer, "unrecognized 'delete' command")
+		return false
+	}
 	noreply := false
-	if cmd.noreply != nil {
-		if !bytes.Equal(cmd.noreply, []byte("noreply")) {
-			clientError(c.Writer, "unrecognized noreply")
+	if n != len(line) {
+		noreplyTok, n2 := nextToken(line, n, "noreply")
+		isNoreply, valid := parseNoreply(c.Writer, noreplyTok)
+		if !valid || n2 != len(line) {
 			return false
 		}
-		noreply = true
+		noreply = isNoreply
 	}
-	txn, err := cache.NewSetTxn(key, size, exptime)
+
+	deleted := cache.Delete(key)
+	cases.del(key)
+	if noreply {
+		return true
+	}
+	reply := "NOT_FOUND\r\n"
+	if deleted {
+		reply = "DELETED\r\n"
+	}
+	_, err := c.Write([]byte(reply))
 	if err != nil {
-		log.Printf("Cannot start 'set' transaction for key=[%s], size=[%d], exptime=[%d]: [%s]", key, size, exptime, err)
-		serverError(c.Writer, "cannot start 'set' transaction")
+		log.Printf("Error when writing response: [%s]", err)
 		return false
 	}
-	defer txn.Commit()
-	n, err := txn.ReadFrom(c.Reader)
+	return true
+}
+
+// incrOrDecr implements incr/decr as a read-parse-int-write cycle
+// under a per-key stripe lock, since the cache has no atomic counter
+// of its own.
+func incrOrDecr(c *bufio.ReadWriter, cache ybc.Cacher, line []byte, locks *keyLockTable, cases *casTable, increment bool) bool {
+	n := -1
+	key, n := nextToken(line, n, "key")
+	if key == nil {
+		clientError(c.Writer, "unrecognized command")
+		return false
+	}
+	deltaTok, n := nextToken(line, n, "delta")
+	if deltaTok == nil {
+		clientError(c.Writer, "unrecognized command")
+		return false
+	}
+	noreply := false
+	if n != len(line) {
+		noreplyTok, n2 := nextToken(line, n, "noreply")
+		isNoreply, valid := parseNoreply(c.Writer, noreplyTok)
+		if !valid || n2 != len(line) {
+			return false
+		}
+		noreply = isNoreply
+	}
+	delta, err := strconv.ParseUint(string(deltaTok), 10, 64)
 	if err != nil {
-		log.Printf("Error when reading payload for key=[%s], size=[%d]: [%s]", key, size, err)
-		clientError(c.Writer, "cannot read payload")
+		clientError(c.Writer, "invalid numeric delta argument")
 		return false
 	}
-	if n != int64(size) {
-		log.Printf("Unexpected payload size=[%d]. Expected [%d]", n, size)
-		clientError(c.Writer, "unexpected payload size")
+
+	mu := locks.Lock(key)
+	defer mu.Unlock()
+
+	item, err := cache.GetItem(key)
+	if err != nil {
+		if err == ybc.ErrNotFound {
+			if !noreply {
+				if _, err := c.Write([]byte("NOT_FOUND\r\n")); err != nil {
+					log.Printf("Error when writing response: [%s]", err)
+					return false
+				}
+			}
+			return true
+		}
+		log.Fatalf("Unexpected error returned by cache.GetItem(): [%s]", err)
+	}
+	var buf bytes.Buffer
+	_, rerr := item.WriteTo(&buf)
+	item.Close()
+	if rerr != nil {
+		serverError(c.Writer, "error reading value")
+		return false
+	}
+	value, err := strconv.ParseUint(strings.TrimSpace(buf.String()), 10, 64)
+	if err != nil {
+		clientError(c.Writer, "cannot increment or decrement non-numeric value")
+		return true
+	}
+	if increment {
+		value += delta
+	} else if delta > value {
+		value = 0
+	} else {
+		value -= delta
+	}
+
+	result := []byte(strconv.FormatUint(value, 10))
+	// Deviates from memcached here: incr/decr re-creates the item with
+	// ybc.MaxTtl instead of preserving whatever exptime it already
+	// had, since the ybc binding doesn't expose a per-item
+	// remaining-ttl query to carry forward (see cmdTtl in the resp
+	// package for the same limitation).
+	txn, err := cache.NewSetTxn(key, len(result), ybc.MaxTtl)
+	if err != nil {
+		log.Printf("Cannot start incr/decr transaction for key=[%s]: [%s]", key, err)
+		serverError(c.Writer, "cannot start transaction")
+		return false
+	}
+	_, err = txn.Write(result)
+	txn.Commit()
+	if err != nil {
+		serverError(c.Writer, "error writing value")
+		return false
+	}
+	cases.bump(key)
+	if noreply {
+		return true
+	}
+	if _, err := c.Write(result); err != nil {
+		log.Printf("Error when writing response: [%s]", err)
 		return false
 	}
+	_, err = c.Write([]byte("\r\n"))
+	return err == nil
+}
+
+func processAppendPrependCmd(c *bufio.ReadWriter, cache ybc.Cacher, line []byte, cmd *setCmd, prepend bool, cases *casTable, stats *serverStats) bool {
+	stats.cmdSet.Add(1)
+	cmd.noreply = nil
+	if !parseSetCmd(line, cmd) {
+		clientError(c.Writer, "unrecognized command")
+		return false
+	}
+	key := cmd.key
+	size, ok := parseSize(cmd.size)
+	if !ok {
+		clientError(c.Writer, "invalid size")
+		return false
+	}
+	noreply, ok := parseNoreply(c.Writer, cmd.noreply)
+	if !ok {
+		return false
+	}
+
+	item, err := cache.GetItem(key)
+	if err != nil {
+		if err == ybc.ErrNotFound {
+			if !discardPayload(c, size, stats) {
+				clientError(c.Writer, "cannot read payload")
+				return false
+			}
+			if !noreply {
+				if _, err := c.Write([]byte("NOT_STORED\r\n")); err != nil {
+					log.Printf("Error when writing response: [%s]", err)
+					return false
+				}
+			}
+			return true
+		}
+		log.Fatalf("Unexpected error returned by cache.GetItem(): [%s]", err)
+	}
+	var oldBuf bytes.Buffer
+	_, rerr := item.WriteTo(&oldBuf)
+	item.Close()
+	if rerr != nil {
+		discardPayload(c, size, stats)
+		serverError(c.Writer, "error reading value")
+		return false
+	}
+
+	newData := make([]byte, size)
+	if _, err := io.ReadFull(c.Reader, newData); err != nil {
+		clientError(c.Writer, "cannot read payload")
+		return false
+	}
+	stats.bytesRead.Add(int64(size))
 	if !readCrLf(c.Reader) {
 		clientError(c.Writer, "cannot read crlf after payload")
 		return false
 	}
+
+	var combined []byte
+	if prepend {
+		combined = append(newData, oldBuf.Bytes()...)
+	} else {
+		combined = append(oldBuf.Bytes(), newData...)
+	}
+	// Deviates from memcached here: append/prepend re-creates the item
+	// with ybc.MaxTtl instead of preserving whatever exptime it
+	// already had, since the ybc binding doesn't expose a per-item
+	// remaining-ttl query to carry forward (see cmdTtl in the resp
+	// package for the same limitation).
+	txn, err := cache.NewSetTxn(key, len(combined), ybc.MaxTtl)
+	if err != nil {
+		log.Printf("Cannot start transaction for key=[%s]: [%s]", key, err)
+		serverError(c.Writer, "cannot start transaction")
+		return false
+	}
+	_, err = txn.Write(combined)
+	txn.Commit()
+	if err != nil {
+		serverError(c.Writer, "error writing value")
+		return false
+	}
+	cases.bump(key)
 	if !noreply {
-		_, err = c.Write([]byte("STORED\r\n"))
-		if err != nil {
+		if _, err := c.Write([]byte("STORED\r\n")); err != nil {
 			log.Printf("Error when writing response: [%s]", err)
 			return false
 		}
@@ -230,47 +691,167 @@ func processSetCmd(c *bufio.ReadWriter, cache ybc.Cacher, line []byte, cmd *setC
 	return true
 }
 
-func processRequest(c *bufio.ReadWriter, cache ybc.Cacher, lineBuf *[]byte, cmd *setCmd) bool {
-	if !readLine(c.Reader, lineBuf) {
-		protocolError(c.Writer)
-		return false
+func processFlushAllCmd(c *bufio.ReadWriter, cache ybc.Cacher, line []byte) bool {
+	noreply := bytes.HasSuffix(bytes.TrimSpace(line), []byte("noreply"))
+	cache.Clear()
+	if noreply {
+		return true
 	}
-	line := *lineBuf
-	if len(line) == 0 {
+	_, err := c.Write([]byte("OK\r\n"))
+	if err != nil {
+		log.Printf("Error when writing response: [%s]", err)
 		return false
 	}
-	if bytes.HasPrefix(line, []byte("get ")) {
-		return processGetCmd(c, cache, line[4:])
-	}
-	if bytes.HasPrefix(line, []byte("gets ")) {
-		return processGetCmd(c, cache, line[5:])
+	return true
+}
+
+func processStatsCmd(c *bufio.ReadWriter, stats *serverStats) bool {
+	fmt.Fprintf(c.Writer, "STAT uptime %d\r\n", int64(stats.uptime()/time.Second))
+	fmt.Fprintf(c.Writer, "STAT curr_connections %d\r\n", stats.currConnections.Load())
+	fmt.Fprintf(c.Writer, "STAT total_connections %d\r\n", stats.totalConnections.Load())
+	fmt.Fprintf(c.Writer, "STAT rejected_connections %d\r\n", stats.rejectedConnections.Load())
+	fmt.Fprintf(c.Writer, "STAT cmd_get %d\r\n", stats.cmdGet.Load())
+	fmt.Fprintf(c.Writer, "STAT cmd_set %d\r\n", stats.cmdSet.Load())
+	fmt.Fprintf(c.Writer, "STAT get_hits %d\r\n", stats.getHits.Load())
+	fmt.Fprintf(c.Writer, "STAT get_misses %d\r\n", stats.getMisses.Load())
+	fmt.Fprintf(c.Writer, "STAT bytes_read %d\r\n", stats.bytesRead.Load())
+	fmt.Fprintf(c.Writer, "STAT bytes_written %d\r\n", stats.bytesWritten.Load())
+	_, err := c.Write([]byte("END\r\n"))
+	if err != nil {
+		log.Printf("Error when writing response: [%s]", err)
+		return false
 	}
-	if bytes.HasPrefix(line, []byte("set ")) {
-		return processSetCmd(c, cache, line[4:], cmd)
+	return true
+}
+
+func processVersionCmd(c *bufio.ReadWriter) bool {
+	_, err := c.Write([]byte("VERSION ybc\r\n"))
+	if err != nil {
+		log.Printf("Error when writing response: [%s]", err)
+		return false
 	}
-	log.Printf("Unrecognized command=[%s]", line)
-	protocolError(c.Writer)
-	return false
+	return true
 }
 
-func handleConn(conn net.Conn, cache ybc.Cacher, readBufferSize, writeBufferSize int, done *sync.WaitGroup) {
+// handleConn serves a single connection until the client disconnects,
+// a protocol error occurs, or s.ctx is cancelled. Cancellation is
+// delivered by forcing conn's deadline to the past, since net.Conn has
+// no other way to interrupt a blocked Read/Write. It peeks the first
+// byte to tell the binary protocol (magic byte 0x80) apart from the
+// text protocol and dispatches to the matching frontend; both share
+// the same Cache, so clients speaking either protocol see the same
+// data.
+func (s *Server) handleConn(conn net.Conn) {
 	defer conn.Close()
-	defer done.Done()
-	r := bufio.NewReaderSize(conn, readBufferSize)
-	w := bufio.NewWriterSize(conn, writeBufferSize)
-	c := bufio.NewReadWriter(r, w)
+	defer s.connsDone.Done()
+	s.stats.totalConnections.Add(1)
+	s.stats.currConnections.Add(1)
+	defer s.stats.currConnections.Add(-1)
+
+	connClosed := make(chan struct{})
+	defer close(connClosed)
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-connClosed:
+		}
+	}()
+
+	r := bufio.NewReaderSize(conn, s.ReadBufferSize)
+	w := bufio.NewWriterSize(conn, s.WriteBufferSize)
 	defer w.Flush()
 
+	first, err := r.Peek(1)
+	if err != nil {
+		return
+	}
+	if first[0] == binaryMagicRequest {
+		handleBinaryConn(r, w, s.Cache, s.locks, s.cases)
+		return
+	}
+
+	// ReadTimeout bounds waiting for and reading a full command.
+	// IdleTimeout is used instead only when ReadTimeout is unset,
+	// since processRequest doesn't distinguish between "waiting for
+	// the next command" and "reading a command already in progress".
+	readDeadline := s.ReadTimeout
+	if readDeadline == 0 {
+		readDeadline = s.IdleTimeout
+	}
+
 	lineBuf := make([]byte, 0, 1024)
 	cmd := setCmd{}
+	authenticated := false
+	ctx := &CmdContext{
+		Conn:          bufio.NewReadWriter(r, w),
+		Cache:         s.Cache,
+		Locks:         s.locks,
+		Cases:         s.cases,
+		Stats:         s.stats,
+		RemoteAddr:    conn.RemoteAddr().String(),
+		cmd:           &cmd,
+		authenticated: &authenticated,
+	}
 	for {
-		if !processRequest(c, cache, &lineBuf, &cmd) {
+		if readDeadline > 0 {
+			conn.SetReadDeadline(time.Now().Add(readDeadline))
+		}
+		// The write deadline must be set before dispatching, not
+		// after: a command that streams a large response (e.g. 'get'
+		// flushing mid-command inside item.WriteTo) writes while
+		// still inside processRequest, so setting it afterward would
+		// leave that write unbounded.
+		if s.WriteTimeout > 0 {
+			conn.SetWriteDeadline(time.Now().Add(s.WriteTimeout))
+		}
+		// A cancellation that landed while the previous command ran had
+		// its past deadline overwritten just above; stop here instead
+		// of serving another command.
+		if s.ctx.Err() != nil {
 			break
 		}
+		err := s.processRequest(ctx, &lineBuf)
 		if r.Buffered() == 0 {
 			w.Flush()
 		}
+		if err != nil {
+			break
+		}
+	}
+}
+
+// processRequest reads one command line, splits it into a verb and
+// its arguments, and runs it through the server's middleware-wrapped
+// dispatch table.
+func (s *Server) processRequest(ctx *CmdContext, lineBuf *[]byte) error {
+	if !readLine(ctx.Conn.Reader, lineBuf) {
+		protocolError(ctx.Conn.Writer)
+		return errHandlerFailed
 	}
+	line := *lineBuf
+	if len(line) == 0 {
+		return errHandlerFailed
+	}
+	verb, args := splitVerb(line)
+	ctx.Verb = string(verb)
+	ctx.Args = args
+	return s.dispatch(ctx)
+}
+
+// Stats is a point-in-time snapshot of the counters Server tracks,
+// mirroring what the 'stats' command reports over the wire.
+type Stats struct {
+	CurrConnections     int64
+	TotalConnections    int64
+	RejectedConnections int64
+	CmdGet              int64
+	CmdSet              int64
+	GetHits             int64
+	GetMisses           int64
+	BytesRead           int64
+	BytesWritten        int64
+	Uptime              time.Duration
 }
 
 type Server struct {
@@ -279,9 +860,57 @@ type Server struct {
 	ReadBufferSize  int
 	WriteBufferSize int
 
+	// MaxConnections caps the number of simultaneously open
+	// connections. Connections beyond this limit are rejected (and
+	// counted in Stats().RejectedConnections) as soon as they're
+	// accepted. Zero means unbounded.
+	MaxConnections int
+
+	// ReadTimeout and WriteTimeout bound how long a single command's
+	// read or write may take. IdleTimeout, if ReadTimeout is unset,
+	// bounds how long a connection may sit between commands. Zero
+	// means no deadline. These apply to text-protocol connections
+	// only; binary-protocol connections run without read or write
+	// deadlines.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+
+	// ShutdownTimeout bounds how long Stop() waits for in-flight
+	// connections to finish on their own after being signalled to
+	// wrap up. Zero means wait forever.
+	ShutdownTimeout time.Duration
+
+	// Handlers maps a command verb to the HandlerFunc that serves it.
+	// Entries left unset at Start are filled in from defaultHandlers,
+	// so registering a custom verb (e.g. "touch") - or overriding a
+	// built-in one - is just adding an entry before Start. Use Use to
+	// add cross-cutting behaviour around every verb instead.
+	Handlers map[string]HandlerFunc
+
 	listenSocket net.Listener
+	locks        *keyLockTable
+	cases        *casTable
+	stats        *serverStats
+	sem          chan struct{}
+	ctx          context.Context
+	cancel       context.CancelFunc
+	connsDone    *sync.WaitGroup
 	done         *sync.WaitGroup
 	err          error
+
+	middlewares []Middleware
+	dispatch    HandlerFunc
+}
+
+// Use appends mw to the middleware chain wrapping every command.
+// Middlewares run in the order they're added: the first Use'd
+// middleware is outermost and sees each command first. Call Use
+// before Start; the chain is built once at startup. Only text-protocol
+// commands pass through the chain; binary-protocol connections are
+// served without it.
+func (s *Server) Use(mw Middleware) {
+	s.middlewares = append(s.middlewares, mw)
 }
 
 func (s *Server) init() {
@@ -295,25 +924,55 @@ func (s *Server) init() {
 	var err error
 	s.listenSocket, err = net.Listen("tcp", s.ListenAddr)
 	if err != nil {
-		log.Fatal("Cannot listen for ListenAddr=[%s]: [%s]", s.ListenAddr, err)
+		log.Fatalf("Cannot listen for ListenAddr=[%s]: [%s]", s.ListenAddr, err)
+	}
+	s.locks = &keyLockTable{}
+	s.cases = newCasTable()
+	s.stats = newServerStats()
+	if s.MaxConnections > 0 {
+		s.sem = make(chan struct{}, s.MaxConnections)
 	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.connsDone = &sync.WaitGroup{}
 	s.done = &sync.WaitGroup{}
 	s.done.Add(1)
+
+	if s.Handlers == nil {
+		s.Handlers = make(map[string]HandlerFunc, len(defaultHandlers))
+	}
+	for verb, h := range defaultHandlers {
+		if _, ok := s.Handlers[verb]; !ok {
+			s.Handlers[verb] = h
+		}
+	}
+	s.dispatch = s.buildDispatch()
 }
 
 func (s *Server) run() {
 	defer s.done.Done()
 
-	connsDone := &sync.WaitGroup{}
-	defer connsDone.Wait()
 	for {
 		conn, err := s.listenSocket.Accept()
 		if err != nil {
 			s.err = err
 			break
 		}
-		connsDone.Add(1)
-		go handleConn(conn, s.Cache, s.ReadBufferSize, s.WriteBufferSize, connsDone)
+		if s.sem != nil {
+			select {
+			case s.sem <- struct{}{}:
+			default:
+				s.stats.rejectedConnections.Add(1)
+				conn.Close()
+				continue
+			}
+		}
+		s.connsDone.Add(1)
+		go func(conn net.Conn) {
+			if s.sem != nil {
+				defer func() { <-s.sem }()
+			}
+			s.handleConn(conn)
+		}(conn)
 	}
 }
 
@@ -335,9 +994,47 @@ func (s *Server) Serve() error {
 	return s.Wait()
 }
 
+// Stop stops accepting new connections, signals in-flight commands to
+// wrap up, and waits for all connections to finish - up to
+// ShutdownTimeout, after which it gives up waiting and returns with
+// whatever connections are still closing in the background.
 func (s *Server) Stop() {
 	s.listenSocket.Close()
+	s.cancel()
 	s.Wait()
+
+	connsDone := make(chan struct{})
+	go func() {
+		s.connsDone.Wait()
+		close(connsDone)
+	}()
+	if s.ShutdownTimeout > 0 {
+		select {
+		case <-connsDone:
+		case <-time.After(s.ShutdownTimeout):
+			log.Printf("Server.Stop(): %d connection(s) still active after ShutdownTimeout=[%s]", s.stats.currConnections.Load(), s.ShutdownTimeout)
+		}
+	} else {
+		<-connsDone
+	}
+
 	s.listenSocket = nil
 	s.done = nil
 }
+
+// Stats returns a snapshot of the server's connection and command
+// counters.
+func (s *Server) Stats() Stats {
+	return Stats{
+		CurrConnections:     s.stats.currConnections.Load(),
+		TotalConnections:    s.stats.totalConnections.Load(),
+		RejectedConnections: s.stats.rejectedConnections.Load(),
+		CmdGet:              s.stats.cmdGet.Load(),
+		CmdSet:              s.stats.cmdSet.Load(),
+		GetHits:             s.stats.getHits.Load(),
+		GetMisses:           s.stats.getMisses.Load(),
+		BytesRead:           s.stats.bytesRead.Load(),
+		BytesWritten:        s.stats.bytesWritten.Load(),
+		Uptime:              s.stats.uptime(),
+	}
+}
@@ -0,0 +1,49 @@
+package memcache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// atomicCounter is a small wrapper around sync/atomic so the counters
+// below read naturally at the call site (stats.cmdGet.Add(1)) instead
+// of threading a *int64 through every call.
+type atomicCounter struct {
+	v int64
+}
+
+func (c *atomicCounter) Add(delta int64) {
+	atomic.AddInt64(&c.v, delta)
+}
+
+func (c *atomicCounter) Load() int64 {
+	return atomic.LoadInt64(&c.v)
+}
+
+// serverStats tracks the counters reported by the 'stats' command.
+// Every field is safe for concurrent use from multiple connection
+// goroutines.
+type serverStats struct {
+	startTime time.Time
+
+	currConnections     atomicCounter
+	totalConnections    atomicCounter
+	rejectedConnections atomicCounter
+
+	cmdGet atomicCounter
+	cmdSet atomicCounter
+
+	getHits   atomicCounter
+	getMisses atomicCounter
+
+	bytesRead    atomicCounter
+	bytesWritten atomicCounter
+}
+
+func newServerStats() *serverStats {
+	return &serverStats{startTime: time.Now()}
+}
+
+func (s *serverStats) uptime() time.Duration {
+	return time.Now().Sub(s.startTime)
+}
@@ -0,0 +1,125 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+)
+
+// cmdReader walks the arguments of a single command, whether it arrived
+// as an inline command (one CRLF-terminated line) or as a multi-bulk
+// array. Command handlers pull arguments one at a time via nextArg, or,
+// for the rare argument that may be large (SETEX's value), via
+// nextBulkLen followed by a direct stream off the underlying reader.
+type cmdReader struct {
+	r          *bufio.Reader
+	multibulk  bool
+	remaining  int
+	inlineArgs [][]byte
+}
+
+func newCmdReader(r *bufio.Reader) (name []byte, cr *cmdReader, ok bool) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, nil, false
+	}
+	if b[0] != '*' {
+		line, ok := readLine(r)
+		if !ok {
+			return nil, nil, false
+		}
+		args := bytes.Fields(line)
+		if len(args) == 0 {
+			return nil, nil, false
+		}
+		return args[0], &cmdReader{r: r, multibulk: false, inlineArgs: args[1:]}, true
+	}
+
+	n, ok := readArrayLen(r)
+	if !ok || n <= 0 {
+		return nil, nil, false
+	}
+	cr = &cmdReader{r: r, multibulk: true, remaining: n - 1}
+	nameLen, ok := readBulkLen(r)
+	if !ok {
+		return nil, nil, false
+	}
+	name, ok = readBulk(r, nameLen)
+	if !ok {
+		return nil, nil, false
+	}
+	return name, cr, true
+}
+
+// nextArg returns the next argument, fully buffered.
+func (cr *cmdReader) nextArg() (arg []byte, ok bool) {
+	if cr.multibulk {
+		if cr.remaining <= 0 {
+			return nil, false
+		}
+		n, ok := readBulkLen(cr.r)
+		if !ok {
+			return nil, false
+		}
+		cr.remaining--
+		return readBulk(cr.r, n)
+	}
+	if len(cr.inlineArgs) == 0 {
+		return nil, false
+	}
+	arg = cr.inlineArgs[0]
+	cr.inlineArgs = cr.inlineArgs[1:]
+	return arg, true
+}
+
+func (cr *cmdReader) argsLeft() int {
+	if cr.multibulk {
+		return cr.remaining
+	}
+	return len(cr.inlineArgs)
+}
+
+// nextBulkLen reads only the length header of the next multi-bulk
+// argument, leaving the payload itself on the reader for the caller to
+// stream directly (e.g. into a ybc.SetTxn). It only works in multibulk
+// mode; callers must fall back to nextArg for inline commands, which
+// are already fully buffered by the time they reach a handler.
+//
+// A negative length (the nil bulk "$-1") is rejected rather than handed
+// to the caller, which would otherwise allocate/index with it.
+func (cr *cmdReader) nextBulkLen() (n int, ok bool) {
+	if !cr.multibulk || cr.remaining <= 0 {
+		return 0, false
+	}
+	n, ok = readBulkLen(cr.r)
+	if !ok {
+		return 0, false
+	}
+	cr.remaining--
+	if n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+func (cr *cmdReader) skipCrLf() bool {
+	return readCrLf(cr.r)
+}
+
+// drain reads and discards any arguments the handler didn't consume, so
+// the next command starts at the right offset on a malformed or
+// partially-handled request.
+func (cr *cmdReader) drain() {
+	for cr.argsLeft() > 0 {
+		if _, ok := cr.nextArg(); !ok {
+			return
+		}
+	}
+}
+
+func readCrLf(r *bufio.Reader) bool {
+	b := make([]byte, 2)
+	if _, err := readFull(r, b); err != nil {
+		return false
+	}
+	return b[0] == '\r' && b[1] == '\n'
+}
@@ -0,0 +1,416 @@
+package resp
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/valyala/ybc/bindings/go/ybc"
+)
+
+// errQuit is returned by the QUIT handler to tell the connection loop
+// to close the connection after flushing the reply.
+var errQuit = io.EOF
+
+// maxBufferedSetValue bounds how much of SET's value cmdSet will buffer
+// in memory while it waits to see the trailing EX/PX/NX/XX options (see
+// cmdSet). A larger value should use SETEX, which streams straight into
+// the txn instead of buffering.
+const maxBufferedSetValue = 1 << 20 // 1MiB
+
+type handlerFunc func(c *Conn, cache ybc.Cacher, cr *cmdReader, locks *keyLockTable) error
+
+var handlers = map[string]handlerFunc{
+	"GET":    cmdGet,
+	"SET":    cmdSet,
+	"SETEX":  cmdSetex,
+	"DEL":    cmdDel,
+	"EXISTS": cmdExists,
+	"MGET":   cmdMget,
+	"MSET":   cmdMset,
+	"TTL":    cmdTtl,
+	"INCR":   cmdIncr,
+	"DECR":   cmdDecr,
+	"PING":   cmdPing,
+	"ECHO":   cmdEcho,
+	"QUIT":   cmdQuit,
+}
+
+func writeItem(c *Conn, item *ybc.Item) error {
+	size := item.Size()
+	if err := c.WriteBulkHeader(size); err != nil {
+		return err
+	}
+	n, err := item.WriteTo(c.w)
+	if err != nil {
+		return err
+	}
+	if n != int64(size) {
+		return io.ErrShortWrite
+	}
+	return c.WriteCrLf()
+}
+
+func cmdGet(c *Conn, cache ybc.Cacher, cr *cmdReader, locks *keyLockTable) error {
+	key, ok := cr.nextArg()
+	if !ok || cr.argsLeft() != 0 {
+		return c.WriteError("ERR wrong number of arguments for 'get' command")
+	}
+	item, err := cache.GetItem(key)
+	if err != nil {
+		if err == ybc.ErrNotFound {
+			return c.WriteBulk(nil)
+		}
+		log.Fatalf("Unexpected error returned by cache.GetItem(): [%s]", err)
+	}
+	defer item.Close()
+	return writeItem(c, item)
+}
+
+// parseSetOptions parses the trailing EX/PX/NX/XX options shared by SET
+// and returns the requested ttl (ybc.MaxTtl if none given) plus the
+// existence precondition, if any.
+func parseSetOptions(cr *cmdReader) (ttl time.Duration, nx, xx bool, ok bool) {
+	ttl = ybc.MaxTtl
+	for cr.argsLeft() > 0 {
+		opt, argOk := cr.nextArg()
+		if !argOk {
+			return 0, false, false, false
+		}
+		switch string(bytes.ToUpper(opt)) {
+		case "EX":
+			secs, argOk := cr.nextArg()
+			if !argOk {
+				return 0, false, false, false
+			}
+			n, err := strconv.Atoi(string(secs))
+			if err != nil {
+				return 0, false, false, false
+			}
+			ttl = time.Duration(n) * time.Second
+		case "PX":
+			ms, argOk := cr.nextArg()
+			if !argOk {
+				return 0, false, false, false
+			}
+			n, err := strconv.Atoi(string(ms))
+			if err != nil {
+				return 0, false, false, false
+			}
+			ttl = time.Duration(n) * time.Millisecond
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		default:
+			return 0, false, false, false
+		}
+	}
+	return ttl, nx, xx, true
+}
+
+func cmdSet(c *Conn, cache ybc.Cacher, cr *cmdReader, locks *keyLockTable) error {
+	key, ok := cr.nextArg()
+	if !ok {
+		return c.WriteError("ERR wrong number of arguments for 'set' command")
+	}
+	var value []byte
+	if cr.multibulk {
+		size, ok := cr.nextBulkLen()
+		if !ok {
+			return c.WriteError("ERR wrong number of arguments for 'set' command")
+		}
+
+		// Unlike a plain SET, the value can't be streamed straight into a
+		// SetTxn here: any EX/PX/NX/XX options trail the value on the
+		// wire, so the final ttl and the NX/XX precondition aren't known
+		// until after it's been read. Buffer it, decide what to do, then
+		// open the txn once with the final ttl. Bound the buffer so a
+		// single oversized SET can't pin arbitrary memory; a value that
+		// large should use SETEX, which streams instead of buffering.
+		if size > maxBufferedSetValue {
+			if _, err := io.CopyN(io.Discard, cr.r, int64(size)); err != nil {
+				return c.WriteError("ERR error reading value")
+			}
+			if !cr.skipCrLf() {
+				return c.WriteError("ERR missing crlf after value")
+			}
+			return c.WriteError("ERR value too large for 'set' command")
+		}
+		value = make([]byte, size)
+		if _, err := io.ReadFull(cr.r, value); err != nil {
+			return c.WriteError("ERR error reading value")
+		}
+		if !cr.skipCrLf() {
+			return c.WriteError("ERR missing crlf after value")
+		}
+	} else if value, ok = cr.nextArg(); !ok {
+		// Inline commands are already fully buffered: the value is
+		// simply the next argument.
+		return c.WriteError("ERR wrong number of arguments for 'set' command")
+	}
+	size := len(value)
+
+	ttl, nx, xx, ok := parseSetOptions(cr)
+	if !ok {
+		return c.WriteError("ERR syntax error")
+	}
+	if nx || xx {
+		existingItem, err := cache.GetItem(key)
+		exists := err == nil
+		if exists {
+			existingItem.Close()
+		}
+		if (nx && exists) || (xx && !exists) {
+			return c.WriteBulk(nil)
+		}
+	}
+
+	txn, err := cache.NewSetTxn(key, size, ttl)
+	if err != nil {
+		log.Printf("Cannot start 'set' transaction for key=[%s], size=[%d]: [%s]", key, size, err)
+		return c.WriteError("ERR cannot start transaction")
+	}
+	if _, err := txn.Write(value); err != nil {
+		txn.Commit()
+		return c.WriteError("ERR error writing value")
+	}
+	txn.Commit()
+	return c.WriteString("OK")
+}
+
+func cmdSetex(c *Conn, cache ybc.Cacher, cr *cmdReader, locks *keyLockTable) error {
+	key, ok := cr.nextArg()
+	if !ok {
+		return c.WriteError("ERR wrong number of arguments for 'setex' command")
+	}
+	secsArg, ok := cr.nextArg()
+	if !ok {
+		return c.WriteError("ERR wrong number of arguments for 'setex' command")
+	}
+	secs, err := strconv.Atoi(string(secsArg))
+	if err != nil {
+		return c.WriteError("ERR value is not an integer or out of range")
+	}
+	if !cr.multibulk {
+		// Inline commands are already fully buffered, so there is
+		// nothing to stream: store the value argument as is.
+		value, ok := cr.nextArg()
+		if !ok {
+			return c.WriteError("ERR wrong number of arguments for 'setex' command")
+		}
+		txn, err := cache.NewSetTxn(key, len(value), time.Duration(secs)*time.Second)
+		if err != nil {
+			return c.WriteError("ERR cannot start transaction")
+		}
+		defer txn.Commit()
+		if _, err := txn.Write(value); err != nil {
+			return c.WriteError("ERR error writing value")
+		}
+		return c.WriteString("OK")
+	}
+	size, ok := cr.nextBulkLen()
+	if !ok {
+		return c.WriteError("ERR wrong number of arguments for 'setex' command")
+	}
+	txn, err := cache.NewSetTxn(key, size, time.Duration(secs)*time.Second)
+	if err != nil {
+		log.Printf("Cannot start 'setex' transaction for key=[%s], size=[%d]: [%s]", key, size, err)
+		return c.WriteError("ERR cannot start transaction")
+	}
+	defer txn.Commit()
+	n, err := txn.ReadFrom(cr.r)
+	if err != nil || n != int64(size) {
+		return c.WriteError("ERR error reading value")
+	}
+	if !cr.skipCrLf() {
+		return c.WriteError("ERR missing crlf after value")
+	}
+	return c.WriteString("OK")
+}
+
+func cmdDel(c *Conn, cache ybc.Cacher, cr *cmdReader, locks *keyLockTable) error {
+	deleted := 0
+	for cr.argsLeft() > 0 {
+		key, ok := cr.nextArg()
+		if !ok {
+			return c.WriteError("ERR protocol error")
+		}
+		if cache.Delete(key) {
+			deleted++
+		}
+	}
+	return c.WriteInt(int64(deleted))
+}
+
+func cmdExists(c *Conn, cache ybc.Cacher, cr *cmdReader, locks *keyLockTable) error {
+	count := 0
+	for cr.argsLeft() > 0 {
+		key, ok := cr.nextArg()
+		if !ok {
+			return c.WriteError("ERR protocol error")
+		}
+		item, err := cache.GetItem(key)
+		if err == nil {
+			item.Close()
+			count++
+		}
+	}
+	return c.WriteInt(int64(count))
+}
+
+func cmdMget(c *Conn, cache ybc.Cacher, cr *cmdReader, locks *keyLockTable) error {
+	keys := make([][]byte, 0, cr.argsLeft())
+	for cr.argsLeft() > 0 {
+		key, ok := cr.nextArg()
+		if !ok {
+			return c.WriteError("ERR protocol error")
+		}
+		keys = append(keys, key)
+	}
+	if err := c.WriteArray(len(keys)); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		item, err := cache.GetItem(key)
+		if err != nil {
+			if err != ybc.ErrNotFound {
+				log.Fatalf("Unexpected error returned by cache.GetItem(): [%s]", err)
+			}
+			if err := c.WriteBulk(nil); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := writeItem(c, item); err != nil {
+			item.Close()
+			return err
+		}
+		item.Close()
+	}
+	return nil
+}
+
+func cmdMset(c *Conn, cache ybc.Cacher, cr *cmdReader, locks *keyLockTable) error {
+	if cr.argsLeft()%2 != 0 {
+		return c.WriteError("ERR wrong number of arguments for 'mset' command")
+	}
+	for cr.argsLeft() > 0 {
+		key, ok := cr.nextArg()
+		if !ok {
+			return c.WriteError("ERR protocol error")
+		}
+		value, ok := cr.nextArg()
+		if !ok {
+			return c.WriteError("ERR protocol error")
+		}
+		txn, err := cache.NewSetTxn(key, len(value), ybc.MaxTtl)
+		if err != nil {
+			log.Printf("Cannot start 'mset' transaction for key=[%s]: [%s]", key, err)
+			return c.WriteError("ERR cannot start transaction")
+		}
+		if _, err := txn.Write(value); err != nil {
+			txn.Commit()
+			return c.WriteError("ERR error writing value")
+		}
+		txn.Commit()
+	}
+	return c.WriteString("OK")
+}
+
+// cmdTtl reports whether key exists, per the TTL semantics Redis
+// clients expect (-2 missing, -1 exists with no further detail). The
+// ybc binding doesn't expose a per-item remaining-ttl query, so a
+// present key's actual expiry can't be reported here.
+func cmdTtl(c *Conn, cache ybc.Cacher, cr *cmdReader, locks *keyLockTable) error {
+	key, ok := cr.nextArg()
+	if !ok || cr.argsLeft() != 0 {
+		return c.WriteError("ERR wrong number of arguments for 'ttl' command")
+	}
+	item, err := cache.GetItem(key)
+	if err != nil {
+		if err == ybc.ErrNotFound {
+			return c.WriteInt(-2)
+		}
+		log.Fatalf("Unexpected error returned by cache.GetItem(): [%s]", err)
+	}
+	item.Close()
+	return c.WriteInt(-1)
+}
+
+func incrDecr(c *Conn, cache ybc.Cacher, cr *cmdReader, locks *keyLockTable, delta int64) error {
+	key, ok := cr.nextArg()
+	if !ok || cr.argsLeft() != 0 {
+		return c.WriteError("ERR wrong number of arguments")
+	}
+
+	mu := locks.Lock(key)
+	defer mu.Unlock()
+
+	var n int64
+	item, err := cache.GetItem(key)
+	if err == nil {
+		var buf bytes.Buffer
+		if _, err := item.WriteTo(&buf); err != nil {
+			item.Close()
+			return c.WriteError("ERR error reading value")
+		}
+		item.Close()
+		n, err = strconv.ParseInt(string(bytes.TrimSpace(buf.Bytes())), 10, 64)
+		if err != nil {
+			return c.WriteError("ERR value is not an integer or out of range")
+		}
+	} else if err != ybc.ErrNotFound {
+		log.Fatalf("Unexpected error returned by cache.GetItem(): [%s]", err)
+	}
+
+	n += delta
+	value := []byte(strconv.FormatInt(n, 10))
+	txn, err := cache.NewSetTxn(key, len(value), ybc.MaxTtl)
+	if err != nil {
+		log.Printf("Cannot start incr/decr transaction for key=[%s]: [%s]", key, err)
+		return c.WriteError("ERR cannot start transaction")
+	}
+	if _, err := txn.Write(value); err != nil {
+		txn.Commit()
+		return c.WriteError("ERR error writing value")
+	}
+	txn.Commit()
+	return c.WriteInt(n)
+}
+
+func cmdIncr(c *Conn, cache ybc.Cacher, cr *cmdReader, locks *keyLockTable) error {
+	return incrDecr(c, cache, cr, locks, 1)
+}
+
+func cmdDecr(c *Conn, cache ybc.Cacher, cr *cmdReader, locks *keyLockTable) error {
+	return incrDecr(c, cache, cr, locks, -1)
+}
+
+func cmdPing(c *Conn, cache ybc.Cacher, cr *cmdReader, locks *keyLockTable) error {
+	if cr.argsLeft() == 0 {
+		return c.WriteString("PONG")
+	}
+	msg, ok := cr.nextArg()
+	if !ok {
+		return c.WriteError("ERR protocol error")
+	}
+	return c.WriteBulk(msg)
+}
+
+func cmdEcho(c *Conn, cache ybc.Cacher, cr *cmdReader, locks *keyLockTable) error {
+	msg, ok := cr.nextArg()
+	if !ok || cr.argsLeft() != 0 {
+		return c.WriteError("ERR wrong number of arguments for 'echo' command")
+	}
+	return c.WriteBulk(msg)
+}
+
+func cmdQuit(c *Conn, cache ybc.Cacher, cr *cmdReader, locks *keyLockTable) error {
+	if err := c.WriteString("OK"); err != nil {
+		return err
+	}
+	return errQuit
+}
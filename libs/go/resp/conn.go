@@ -0,0 +1,90 @@
+package resp
+
+import (
+	"bufio"
+	"strconv"
+)
+
+// Conn wraps the buffered reader/writer pair for a single RESP
+// connection and exposes the reply-type writers the command handlers
+// use to talk back to the client.
+type Conn struct {
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func newConn(r *bufio.Reader, w *bufio.Writer) *Conn {
+	return &Conn{r: r, w: w}
+}
+
+// WriteBulk writes a RESP bulk string. A nil b is written as a nil
+// bulk ("$-1\r\n"), matching GET on a missing key.
+func (c *Conn) WriteBulk(b []byte) error {
+	if b == nil {
+		_, err := c.w.WriteString("$-1\r\n")
+		return err
+	}
+	if _, err := c.w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n"); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(b); err != nil {
+		return err
+	}
+	_, err := c.w.WriteString("\r\n")
+	return err
+}
+
+// WriteBulkHeader writes just the "$<size>\r\n" header of a bulk
+// string reply. It is used together with WriteRaw/WriteCrLf by
+// handlers that stream a payload straight from the cache (e.g. GET)
+// instead of buffering it into a []byte first.
+func (c *Conn) WriteBulkHeader(size int) error {
+	_, err := c.w.WriteString("$" + strconv.Itoa(size) + "\r\n")
+	return err
+}
+
+// WriteRaw writes b to the connection without any framing.
+func (c *Conn) WriteRaw(b []byte) error {
+	_, err := c.w.Write(b)
+	return err
+}
+
+// WriteCrLf writes the trailing CRLF that terminates a bulk payload
+// written via WriteBulkHeader/WriteRaw.
+func (c *Conn) WriteCrLf() error {
+	_, err := c.w.WriteString("\r\n")
+	return err
+}
+
+// WriteInt writes a RESP integer reply.
+func (c *Conn) WriteInt(n int64) error {
+	_, err := c.w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+	return err
+}
+
+// WriteString writes a RESP simple string reply, e.g. "+OK\r\n".
+func (c *Conn) WriteString(s string) error {
+	_, err := c.w.WriteString("+" + s + "\r\n")
+	return err
+}
+
+// WriteError writes a RESP error reply.
+func (c *Conn) WriteError(s string) error {
+	_, err := c.w.WriteString("-" + s + "\r\n")
+	return err
+}
+
+// WriteArray writes the header of a RESP array reply with n elements.
+// The caller is responsible for writing the n elements that follow,
+// e.g. via repeated WriteBulk calls.
+func (c *Conn) WriteArray(n int) error {
+	_, err := c.w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+	return err
+}
+
+// WriteNilArray writes a nil array reply ("*-1\r\n"). MGET does not use
+// it: with no keys it replies with an empty array ("*0\r\n").
+func (c *Conn) WriteNilArray() error {
+	_, err := c.w.WriteString("*-1\r\n")
+	return err
+}
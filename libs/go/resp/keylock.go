@@ -0,0 +1,24 @@
+package resp
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// keyLockTable locks keys for the read-modify-write sequences that
+// INCR/DECR need (the ybc cache itself has no atomic counter
+// operation). A fixed number of stripes keeps lock contention low
+// without allocating one mutex per key.
+const keyLockStripeCount = 256
+
+type keyLockTable struct {
+	stripes [keyLockStripeCount]sync.Mutex
+}
+
+func (t *keyLockTable) Lock(key []byte) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write(key)
+	m := &t.stripes[h.Sum32()%keyLockStripeCount]
+	m.Lock()
+	return m
+}
@@ -0,0 +1,104 @@
+package resp
+
+import (
+	"bufio"
+	"log"
+	"strconv"
+)
+
+// readLine reads a single CRLF-terminated line from r, excluding the
+// trailing "\r\n". It mirrors the text-protocol readLine() used by the
+// memcache server, but is kept private to this package since the RESP
+// wire format has its own framing rules (inline vs. multi-bulk).
+func readLine(r *bufio.Reader) ([]byte, bool) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		if err != bufio.ErrBufferFull {
+			log.Printf("Error when reading line: [%s]", err)
+		}
+		return nil, false
+	}
+	n := len(line)
+	if n < 2 || line[n-2] != '\r' {
+		log.Printf("Unexpected line terminator in line=[%s]", line)
+		return nil, false
+	}
+	// readLine's caller may hold onto the returned slice past the next
+	// read, so make a copy instead of returning bufio's internal buffer.
+	buf := make([]byte, n-2)
+	copy(buf, line[:n-2])
+	return buf, true
+}
+
+// readArrayLen reads a "*<n>\r\n" header and returns n.
+func readArrayLen(r *bufio.Reader) (n int, ok bool) {
+	line, ok := readLine(r)
+	if !ok {
+		return 0, false
+	}
+	if len(line) == 0 || line[0] != '*' {
+		log.Printf("Expected '*' at the start of array header, got=[%s]", line)
+		return 0, false
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil {
+		log.Printf("Cannot parse array length from=[%s]: [%s]", line, err)
+		return 0, false
+	}
+	return n, true
+}
+
+// readBulkLen reads a "$<n>\r\n" header and returns n. A negative n
+// represents a nil bulk string.
+func readBulkLen(r *bufio.Reader) (n int, ok bool) {
+	line, ok := readLine(r)
+	if !ok {
+		return 0, false
+	}
+	if len(line) == 0 || line[0] != '$' {
+		log.Printf("Expected '$' at the start of bulk header, got=[%s]", line)
+		return 0, false
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil {
+		log.Printf("Cannot parse bulk length from=[%s]: [%s]", line, err)
+		return 0, false
+	}
+	return n, true
+}
+
+// readBulk reads a bulk string of the given length plus its trailing
+// CRLF, returning the payload. Callers that expect a potentially large
+// payload (e.g. the SETEX command's value) should not use this helper and
+// should instead stream the body directly off the connection's reader.
+//
+// A negative n (the nil bulk "$-1") is rejected: this server has no use
+// for a nil argument, and allocating/indexing on it would panic.
+func readBulk(r *bufio.Reader, n int) ([]byte, bool) {
+	if n < 0 {
+		log.Printf("Unexpected nil bulk length=[%d]", n)
+		return nil, false
+	}
+	buf := make([]byte, n+2)
+	if _, err := readFull(r, buf); err != nil {
+		log.Printf("Error when reading bulk payload of size=[%d]: [%s]", n, err)
+		return nil, false
+	}
+	if buf[n] != '\r' || buf[n+1] != '\n' {
+		log.Printf("Missing crlf after bulk payload of size=[%d]", n)
+		return nil, false
+	}
+	return buf[:n], true
+}
+
+func readFull(r *bufio.Reader, buf []byte) (int, error) {
+	read := 0
+	for read < len(buf) {
+		n, err := r.Read(buf[read:])
+		read += n
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
@@ -0,0 +1,140 @@
+// Package resp exposes a ybc.Cacher through a Redis-compatible (RESP)
+// line protocol, so existing Redis clients can drive the same backing
+// store the memcache server (see the sibling memcache package) uses.
+package resp
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/valyala/ybc/bindings/go/ybc"
+)
+
+const (
+	defaultReadBufferSize  = 4096
+	defaultWriteBufferSize = 4096
+)
+
+func handleConn(conn net.Conn, cache ybc.Cacher, readBufferSize, writeBufferSize int, locks *keyLockTable, done *sync.WaitGroup) {
+	defer conn.Close()
+	defer done.Done()
+	r := bufio.NewReaderSize(conn, readBufferSize)
+	w := bufio.NewWriterSize(conn, writeBufferSize)
+	c := newConn(r, w)
+
+	for {
+		name, cr, ok := newCmdReader(r)
+		if !ok {
+			break
+		}
+		handler, found := handlers[string(bytesToUpper(name))]
+		if !found {
+			cr.drain()
+			c.WriteError("ERR unknown command '" + string(name) + "'")
+			w.Flush()
+			continue
+		}
+		err := handler(c, cache, cr, locks)
+		cr.drain()
+		if r.Buffered() == 0 {
+			w.Flush()
+		}
+		if err != nil {
+			w.Flush()
+			break
+		}
+	}
+}
+
+func bytesToUpper(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i, c := range b {
+		if c >= 'a' && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		out[i] = c
+	}
+	return out
+}
+
+// Server mirrors memcache.Server: it owns a listen socket and serves a
+// ybc.Cacher to connecting clients, but speaks RESP instead of the
+// memcache text protocol.
+type Server struct {
+	Cache           ybc.Cacher
+	ListenAddr      string
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	listenSocket net.Listener
+	locks        *keyLockTable
+	done         *sync.WaitGroup
+	err          error
+}
+
+func (s *Server) init() {
+	if s.ReadBufferSize == 0 {
+		s.ReadBufferSize = defaultReadBufferSize
+	}
+	if s.WriteBufferSize == 0 {
+		s.WriteBufferSize = defaultWriteBufferSize
+	}
+
+	var err error
+	s.listenSocket, err = net.Listen("tcp", s.ListenAddr)
+	if err != nil {
+		log.Fatalf("Cannot listen for ListenAddr=[%s]: [%s]", s.ListenAddr, err)
+	}
+	s.locks = &keyLockTable{}
+	s.done = &sync.WaitGroup{}
+	s.done.Add(1)
+}
+
+func (s *Server) run() {
+	defer s.done.Done()
+
+	connsDone := &sync.WaitGroup{}
+	defer connsDone.Wait()
+	for {
+		conn, err := s.listenSocket.Accept()
+		if err != nil {
+			s.err = err
+			break
+		}
+		connsDone.Add(1)
+		go handleConn(conn, s.Cache, s.ReadBufferSize, s.WriteBufferSize, s.locks, connsDone)
+	}
+}
+
+// Start begins serving connections in a background goroutine.
+func (s *Server) Start() {
+	if s.listenSocket != nil || s.done != nil {
+		panic("Did you forgot calling Server.Stop() before calling Server.Start()?")
+	}
+	s.init()
+	go s.run()
+}
+
+// Wait blocks until the server stops serving and returns the error, if
+// any, that caused it to stop.
+func (s *Server) Wait() error {
+	s.done.Wait()
+	return s.err
+}
+
+// Serve starts the server and blocks until it stops.
+func (s *Server) Serve() error {
+	s.Start()
+	return s.Wait()
+}
+
+// Stop closes the listen socket and waits for all in-flight
+// connections to finish.
+func (s *Server) Stop() {
+	s.listenSocket.Close()
+	s.Wait()
+	s.listenSocket = nil
+	s.done = nil
+}